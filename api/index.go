@@ -1,28 +1,97 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"math"
+	mrand "math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/tracelog"
 	"github.com/open-spaced-repetition/go-fsrs/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type application struct {
-	db   *pgxpool.Pool
-	tmpl *template.Template
+	// db serves the deck-wide queries; card reads and writes go through
+	// cards. readDB and readCards are the same over the read replica, for
+	// endpoints that only read and can live with replication lag; without
+	// a replica they are db and cards.
+	db        *pgxpool.Pool
+	cards     CardRepository
+	readDB    *pgxpool.Pool
+	readCards CardRepository
+	tmpl      map[string]*template.Template
+	// sched holds the settings POST /admin/reload can swap while the app
+	// runs. Load it once per operation so one grade never mixes two
+	// configurations.
+	sched        atomic.Pointer[scheduling]
+	aspects      []string
+	logReveals   bool
+	dueCount     *dueCountCache
+	nextDueCache *nextDueCache
+	optimizeJobs *optimizeJobs
+	debounce     *gradeDebounce
+	queryTimeout time.Duration
+	tokenKey     []byte
+	tokenTTL     time.Duration
+	identify     identifier
+	timezone     *time.Location
+	apiKeys      [][]byte
+	tts          *ttsClient // nil when TTS_URL is unset
+	metrics      *metrics
+	// bg is the context of background work, which stop ends.
+	bg   context.Context
+	stop context.CancelFunc
+	// clock is the time handlers and queue queries treat as now;
+	// everything outside tests uses realClock.
+	clock   clock
+	handler http.Handler
+	// inFlight counts the requests being served, so shutdown can report
+	// how many it drained.
+	inFlight atomic.Int64
+	// config is the configuration initApp started with, for /admin/debug.
+	config dbConfig
 }
 
 type dbConfig struct {
@@ -32,21 +101,144 @@ type dbConfig struct {
 	Password string
 	KairosDB string
 	SSLMode  string
+	// ReplicaHost, from PGHOST_REPLICA, is a read replica for the
+	// read-only endpoints, reached with the same user, password and
+	// database; ReplicaPort (PGPORT_REPLICA) defaults to Port. Empty means
+	// everything uses the primary.
+	ReplicaHost string
+	ReplicaPort string
+	DevMode     bool
+	// LogLevel is the minimum level logged, from LOG_LEVEL. DevMode also
+	// switches the log format from JSON to text.
+	LogLevel slog.Level
+	// MigrateOnStartup applies pending migrations during initApp, before
+	// anything else touches the schema.
+	MigrateOnStartup bool
+	// RepairOnStartup runs repairCardStates once during initApp.
+	RepairOnStartup bool
+	// Aspects lists the extra aspects scheduled besides recognition.
+	Aspects []string
+	// LogReveals records answer reveals for drop-off analytics.
+	LogReveals bool
+	// MinRepsBeforeMature (0 = off) is the reps_ct a card needs before its
+	// interval may exceed ImmatureMaxIntervalDays.
+	MinRepsBeforeMature     int
+	ImmatureMaxIntervalDays int
+	// DueCountCacheTTL is how long the due count is served from memory;
+	// 0 disables the cache.
+	DueCountCacheTTL time.Duration
+	// NextDueCacheTTL caps how long a next-due card is served from
+	// memory (see nextDueCache); 0 disables the cache.
+	NextDueCacheTTL time.Duration
+	// GradeDebounce (0 = off) is how soon after a grade the same card's
+	// next grade is refused as a double submission; see gradeDebounce.
+	GradeDebounce time.Duration
+	// LearnAhead (0 = off) is how early a Learning or Relearning card may
+	// be shown when nothing else is due; see application.nextDue.
+	LearnAhead time.Duration
+	// NewCardsPerDay (0 = no limit) is how many New cards the queue
+	// introduces per day in Timezone. After a break of more than
+	// NewCardRampAfterDays (0 = off) days without a review, the limit
+	// starts low and climbs back over NewCardRampDays; see newCardLimit.
+	NewCardsPerDay       int
+	NewCardRampAfterDays int
+	NewCardRampDays      int
+	// QueryTimeout bounds the database work of a single request.
+	QueryTimeout time.Duration
+	// PoolMaxConns and PoolMinConns size the connection pool; 0 keeps
+	// pgxpool's default (or the pool_max_conns URL parameter).
+	PoolMaxConns int
+	PoolMinConns int
+	// QueryExecMode is how pgx runs queries, from PGX_EXEC_MODE. The
+	// default caches a prepared statement per query text on each
+	// connection, so the queue, lookup and update queries are parsed and
+	// planned once per connection rather than on every call. Behind a
+	// transaction-mode pooler such as PgBouncer, where prepared statements
+	// do not survive, use describe_exec or simple_protocol.
+	QueryExecMode pgx.QueryExecMode
+	// StatementCacheSize (0 = pgx's default of 512) bounds the prepared
+	// statements kept per connection.
+	StatementCacheSize int
+	// ConnectRetries is how many times initApp tries to reach Postgres
+	// before giving up.
+	ConnectRetries int
+	// ShutdownTimeout bounds how long Main waits for in-flight requests
+	// to finish after SIGINT or SIGTERM before closing the pool.
+	ShutdownTimeout time.Duration
+	// APIKeys are the shared secrets accepted by withAPIKey, from API_KEY
+	// or the comma-separated API_KEYS. Empty disables the check.
+	APIKeys []string
+	// LeechThreshold (0 = off) is the lapse count at which a card is
+	// flagged as a leech; LeechSuspend also suspends it then.
+	LeechThreshold int
+	LeechSuspend   bool
+	// Timezone is the zone calendar days are counted in, from
+	// APP_TIMEZONE or else TZ; UTC when neither is set.
+	Timezone *time.Location
+	// ReviewOrder is how /review picks the next due card unless ?order=
+	// overrides it.
+	ReviewOrder reviewOrder
+	// GradeButtons is which ratings the review page offers, from
+	// GRADE_BUTTONS.
+	GradeButtons gradeButtons
+	// UserHeader, when set, names the request header that identifies the
+	// user (see headerIdentity). Unset means a single shared deck.
+	UserHeader string
+	// TokenSecret keys the HMAC on review tokens; TokenTTL is how long a
+	// shown card can wait for its grade.
+	TokenSecret []byte
+	TokenTTL    time.Duration
+	// TTSURL and TTSKey configure the speech service behind /audio; see
+	// ttsClient. An empty TTSURL turns audio off.
+	TTSURL string
+	TTSKey string
+	// FSRS holds the scheduler parameters from FSRS_WEIGHTS and
+	// DESIRED_RETENTION, defaulting to fsrs.DefaultParam(). That keeps
+	// EnableShortTerm on, so learning and relearning steps are minutes.
+	// A user's user_params row overrides the weights and retention; see
+	// application.schedFor.
+	FSRS fsrs.Parameters
 }
 
 type Card struct {
-	Headword   string    `db:"headword"`
-	Pinyin     string    `db:"pinyin"`
-	EnDef      string    `db:"en_def"`
-	ZhDef      string    `db:"zh_def"`
-	Freq       int       `db:"freq"`
-	Stability  float64   `db:"stability"`
-	Difficulty float64   `db:"difficulty"`
-	Lapses     int       `db:"lapses"`
-	State      int       `db:"state"`
-	LastReview time.Time `db:"last_review"`
-	Due        time.Time `db:"due_at"`
-	Reps       int       `db:"reps_ct"`
+	Headword  string   `db:"headword" json:"headword"`
+	Pinyin    string   `db:"pinyin" json:"pinyin"`
+	EnDef     string   `db:"en_def" json:"en_def"`
+	ZhDef     string   `db:"zh_def" json:"zh_def"`
+	Freq      int      `db:"freq" json:"freq"`
+	ExampleZh string   `db:"example_sentence_zh" json:"example_sentence_zh"`
+	ExampleEn string   `db:"example_sentence_en" json:"example_sentence_en"`
+	HSK       int      `db:"hsk_level" json:"hsk_level"`
+	Tags      []string `db:"tags" json:"tags"`
+	// DesiredRetention overrides the scheduler's RequestRetention for
+	// this card's intervals; nil uses the global one.
+	DesiredRetention *float64  `db:"desired_retention" json:"desired_retention,omitempty"`
+	Stability        float64   `db:"stability" json:"stability"`
+	Difficulty       float64   `db:"difficulty" json:"difficulty"`
+	Lapses           int       `db:"lapses" json:"lapses"`
+	State            int       `db:"state" json:"state"`
+	LastReview       time.Time `db:"last_review" json:"last_review"`
+	Due              time.Time `db:"due_at" json:"due_at"`
+	Reps             int       `db:"reps_ct" json:"reps_ct"`
+	Suspended        bool      `db:"suspended" json:"suspended"`
+	Aspect           string    `db:"aspect" json:"aspect"`
+	// Version counts writes to the schedule; saveCard only writes over
+	// the version it was read at.
+	Version int `db:"version" json:"version"`
+}
+
+// Aspects are the independently scheduled ways of testing one entry. The
+// recognition aspect is scheduled by the entries row itself; the others
+// live in card_aspects keyed by (user_id, headword, aspect).
+const (
+	aspectRecognition = "recognition" // headword -> pinyin and meaning
+	aspectPinyin      = "pinyin"      // headword -> pinyin
+	aspectProduction  = "production"  // meaning -> headword
+)
+
+var extraAspects = map[string]bool{
+	aspectPinyin:     true,
+	aspectProduction: true,
 }
 
 const cardQuery = `
@@ -55,24 +247,158 @@ headword, pinyin,
 english_definition as en_def,
 chinese_definition as zh_def,
 coalesce(freq, 0) as freq,
+coalesce(example_sentence_zh, '') as example_sentence_zh,
+coalesce(example_sentence_en, '') as example_sentence_en,
+coalesce(hsk_level, 0) as hsk_level,
+tags,
+desired_retention,
 stability, difficulty, lapses, state,
 last_review,
 due_at,
-reps_ct
+reps_ct,
+suspended,
+version
 from entries
 `
 
+// aspectCardQuery joins an aspect's schedule onto its entry's content, in
+// cardQuery's column order plus the aspect name.
+const aspectCardQuery = `
+select
+e.headword, e.pinyin,
+e.english_definition as en_def,
+e.chinese_definition as zh_def,
+coalesce(e.freq, 0) as freq,
+coalesce(e.example_sentence_zh, '') as example_sentence_zh,
+coalesce(e.example_sentence_en, '') as example_sentence_en,
+coalesce(e.hsk_level, 0) as hsk_level,
+e.tags,
+e.desired_retention,
+a.stability, a.difficulty, a.lapses, a.state,
+a.last_review,
+a.due_at,
+a.reps_ct,
+e.suspended,
+a.aspect,
+a.version
+from card_aspects a
+join entries e on e.user_id = a.user_id and e.headword = a.headword and e.deleted_at is null
+`
+
 const (
-	nextDueQuery    = cardQuery + ` where now() >= due_at order by due_at asc limit 1`
-	byHeadwordQuery = cardQuery + ` where headword = $1`
+	nextDueAspectQuery        = aspectCardQuery + ` where a.user_id = $1 and $3 >= a.due_at and a.aspect = any($2) and not e.suspended and ($4::int = 0 or e.hsk_level = $4) and ($5::text = '' or $5 = any(e.tags)) and not ($6::bool and a.state = 0) order by a.due_at asc, coalesce(e.freq, 0) desc, a.headword, a.aspect limit 1`
+	nextDueAspectFreqQuery    = aspectCardQuery + ` where a.user_id = $1 and $3 >= a.due_at and a.aspect = any($2) and not e.suspended and ($4::int = 0 or e.hsk_level = $4) and ($5::text = '' or $5 = any(e.tags)) and not ($6::bool and a.state = 0) order by coalesce(e.freq, 0) desc, a.headword, a.aspect limit 1`
+	nextDueAspectRandomQuery  = aspectCardQuery + ` where a.user_id = $1 and $3 >= a.due_at and a.aspect = any($2) and not e.suspended and ($4::int = 0 or e.hsk_level = $4) and ($5::text = '' or $5 = any(e.tags)) and not ($6::bool and a.state = 0) order by random() limit 1`
+	learnAheadAspectQuery     = aspectCardQuery + ` where a.user_id = $1 and $3 >= a.due_at and a.state in (1, 3) and a.aspect = any($2) and not e.suspended and ($4::int = 0 or e.hsk_level = $4) and ($5::text = '' or $5 = any(e.tags)) order by a.due_at, coalesce(e.freq, 0) desc, a.headword, a.aspect limit 1`
+	byHeadwordAspectQuery     = aspectCardQuery + ` where a.user_id = $1 and a.headword = $2 and a.aspect = $3`
+	lockByHeadwordAspectQuery = byHeadwordAspectQuery + ` for update of a`
 )
 
-func (c Card) mapToFSRS() fsrs.Card {
+const (
+	// nextDueQuery serves due reviews first, oldest due first, then new
+	// cards in curated new_order and, failing that, most frequent first.
+	// The trailing freq/headword keys make ties on due_at (common after an
+	// import) resolve the same way on every request.
+	nextDueQuery = cardQuery + ` where user_id = $1 and $2 >= due_at and not suspended and deleted_at is null and ($3::int = 0 or hsk_level = $3) and ($4::text = '' or $4 = any(tags)) and not ($5::bool and state = 0)
+order by
+state = 0,
+case when state = 0 then new_order end asc nulls last,
+case when state = 0 then coalesce(freq, 0) end desc,
+due_at asc,
+coalesce(freq, 0) desc,
+headword
+limit 1`
+	// nextDueFreqQuery serves due cards, new or not, most frequent first.
+	nextDueFreqQuery = cardQuery + ` where user_id = $1 and $2 >= due_at and not suspended and deleted_at is null and ($3::int = 0 or hsk_level = $3) and ($4::text = '' or $4 = any(tags)) and not ($5::bool and state = 0)
+order by coalesce(freq, 0) desc, headword
+limit 1`
+	// nextDueRandomQuery serves due cards in no particular order, so their
+	// position in the queue can't become a cue.
+	nextDueRandomQuery = cardQuery + ` where user_id = $1 and $2 >= due_at and not suspended and deleted_at is null and ($3::int = 0 or hsk_level = $3) and ($4::text = '' or $4 = any(tags)) and not ($5::bool and state = 0)
+order by random()
+limit 1`
+	// learnAheadQuery serves the Learning (1) or Relearning (3) card due
+	// soonest, up to $2, breaking ties the way nextDueQuery does.
+	learnAheadQuery = cardQuery + ` where user_id = $1 and $2 >= due_at and state in (1, 3) and not suspended and deleted_at is null and ($3::int = 0 or hsk_level = $3) and ($4::text = '' or $4 = any(tags))
+order by due_at, coalesce(freq, 0) desc, headword
+limit 1`
+	byHeadwordQuery = cardQuery + ` where user_id = $1 and headword = $2 and deleted_at is null`
+	// cramQuery walks the whole deck regardless of due dates, hardest
+	// cards first; $2 is the position reached so far.
+	cramQuery = cardQuery + ` where user_id = $1 and not suspended and deleted_at is null
+order by difficulty desc, coalesce(freq, 0) desc, headword
+offset $2
+limit 1`
+	// lockByHeadwordQuery holds the row for the rest of the transaction so
+	// concurrent grades of one card apply one after the other.
+	lockByHeadwordQuery = byHeadwordQuery + ` for update`
+	// neighborsQuery ranks the deck by frequency (most frequent first) and
+	// returns the $3 cards on either side of $2, excluding $2 itself.
+	neighborsQuery = `
+with ranked as (
+	select headword as hw, row_number() over (order by coalesce(freq, 0) desc, headword collate "C") as rn
+	from entries
+	where user_id = $1 and deleted_at is null
+),
+target as (select rn as trn from ranked where hw = $2)
+` + cardQuery + ` join ranked on hw = headword cross join target
+where user_id = $1 and rn between trn - $3 and trn + $3 and hw <> $2
+order by rn`
+)
+
+// clock abstracts time.Now so the moment a request happens at can be
+// pinned.
+//
+// Time invariant: due_at, last_review and every other stored moment are
+// timestamptz, i.e. absolute instants, and are compared as instants; the
+// queue asks for cards with due_at <= now, never for cards due "today".
+// A zone only matters when instants are grouped into calendar days
+// (forecast, heatmap, streak), and those queries convert with
+// AT TIME ZONE app.timezone (APP_TIMEZONE) rather than relying on the
+// server's or the database session's zone.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// dbtx is satisfied by both *pgxpool.Pool and pgx.Tx, so write helpers
+// can run on their own or as part of a larger transaction.
+type dbtx interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// txBeginner is a dbtx that can open a transaction of its own: a pool, or
+// a pgx.Tx, whose Begin makes a savepoint.
+type txBeginner interface {
+	dbtx
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// wholeDays rounds d to the nearest day, clamping negatives (a LastReview
+// in the future) to zero instead of letting them wrap around in a uint64.
+func wholeDays(d time.Duration) uint64 {
+	return uint64(math.Max(math.Round(d.Hours()/24), 0))
+}
+
+// mapToFSRS converts c for the scheduler. A never-reviewed card is handed
+// over as fsrs.NewCard() whatever its stored columns hold (a zero or
+// placeholder last_review would otherwise produce nonsense elapsed and
+// scheduled days), so its first grade takes FSRS's initial-stability path.
+// Elapsed days are counted up to now, the moment being scheduled.
+func (c Card) mapToFSRS(now time.Time) fsrs.Card {
+	if fsrs.State(c.State) == fsrs.New {
+		return fsrs.NewCard()
+	}
 	return fsrs.Card{
 		Stability:     c.Stability,
 		Difficulty:    c.Difficulty,
-		ElapsedDays:   uint64(time.Since(c.LastReview).Hours() / 24),
-		ScheduledDays: uint64(math.Round(c.Due.Sub(c.LastReview).Hours() / 24)),
+		ElapsedDays:   wholeDays(now.Sub(c.LastReview)),
+		ScheduledDays: wholeDays(c.Due.Sub(c.LastReview)),
 		Reps:          uint64(c.Reps),
 		Lapses:        uint64(c.Lapses),
 		State:         fsrs.State(c.State),
@@ -80,6 +406,90 @@ func (c Card) mapToFSRS() fsrs.Card {
 	}
 }
 
+// intervalDays is FSRS's retrievability-to-interval formula: the number of
+// days until recall probability decays to p.RequestRetention, rounded and
+// clamped to [1, p.MaximumInterval]. It mirrors the library's unexported
+// nextInterval without fuzz.
+func intervalDays(p fsrs.Parameters, stability float64) float64 {
+	ivl := stability / p.Factor * (math.Pow(p.RequestRetention, 1/p.Decay) - 1)
+	return math.Max(math.Min(math.Round(ivl), p.MaximumInterval), 1)
+}
+
+// withRetention is p with a card's desired retention, if it has one, in
+// place of the global RequestRetention.
+func withRetention(p fsrs.Parameters, retention *float64) fsrs.Parameters {
+	if retention != nil {
+		p.RequestRetention = *retention
+	}
+	return p
+}
+
+// parseRetention validates a desired_retention form value; "" is nil,
+// meaning the global DESIRED_RETENTION.
+func parseRetention(s string) (*float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(r > 0 && r < 1) {
+		return nil, fmt.Errorf("desired retention %q must be between 0 and 1 exclusive", s)
+	}
+	return &r, nil
+}
+
+// queryExecModes are the PGX_EXEC_MODE values.
+var queryExecModes = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
+}
+
+// loadTimezone loads an IANA zone by name. "Local" is refused: it names
+// whatever zone the server happens to run in, which Postgres cannot
+// resolve.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, errors.New(`"Local" is not an IANA time zone name`)
+	}
+	return time.LoadLocation(name)
+}
+
+// loadEnvFile sets the KEY=VALUE lines of path (blank lines and # comments
+// skipped, values optionally quoted) as environment variables, over any
+// already set. It is how ENV_FILE feeds config in, at startup and again on
+// each /admin/reload, since a running process's environment can't be
+// changed from outside. An empty path does nothing.
+func loadEnvFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("%s:%d: want KEY=VALUE", path, i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+	}
+	return nil
+}
+
 func getenvRequired(key string) (string, error) {
 	v := os.Getenv(key)
 	if v == "" {
@@ -96,6 +506,80 @@ func getenvDefault(key, def string) string {
 	return v
 }
 
+func getenvBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+func getenvInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func getenvDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// loadFSRSParams builds scheduler parameters from FSRS_WEIGHTS (19
+// comma-separated floats, as produced by the FSRS optimizer) and
+// DESIRED_RETENTION. Unset variables keep the library defaults.
+func loadFSRSParams() (fsrs.Parameters, error) {
+	p := fsrs.DefaultParam()
+	if v := os.Getenv("FSRS_WEIGHTS"); v != "" {
+		fields := strings.Split(v, ",")
+		if len(fields) != len(p.W) {
+			return p, fmt.Errorf("invalid FSRS_WEIGHTS: want %d values, got %d", len(p.W), len(fields))
+		}
+		for i, f := range fields {
+			w, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+			if err != nil {
+				return p, fmt.Errorf("invalid FSRS_WEIGHTS: w[%d]: %w", i, err)
+			}
+			if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+				return p, fmt.Errorf("invalid FSRS_WEIGHTS: w[%d] = %v must be finite and non-negative", i, w)
+			}
+			// w[0..3] are the initial stabilities for each rating.
+			if i < 4 && w == 0 {
+				return p, fmt.Errorf("invalid FSRS_WEIGHTS: initial stability w[%d] must be positive", i)
+			}
+			p.W[i] = w
+		}
+	}
+	if v := os.Getenv("DESIRED_RETENTION"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid DESIRED_RETENTION: %w", err)
+		}
+		if r <= 0 || r >= 1 {
+			return p, fmt.Errorf("invalid DESIRED_RETENTION: %v must be between 0 and 1 exclusive", r)
+		}
+		p.RequestRetention = r
+	}
+	return p, nil
+}
+
 func loadDBConfigFromEnv() (dbConfig, error) {
 	host, err := getenvRequired("PGHOST")
 	if err != nil {
@@ -115,13 +599,240 @@ func loadDBConfigFromEnv() (dbConfig, error) {
 		return dbConfig{}, err
 	}
 	sslmode := getenvDefault("PGSSLMODE", "require")
+	replicaHost := os.Getenv("PGHOST_REPLICA")
+	replicaPort := getenvDefault("PGPORT_REPLICA", port)
+	devMode, err := getenvBool("DEV_MODE", false)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	migrateOnStartup, err := getenvBool("MIGRATE_ON_STARTUP", false)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	repair, err := getenvBool("REPAIR_ON_STARTUP", false)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	logReveals, err := getenvBool("LOG_REVEALS", false)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	minReps, err := getenvInt("MIN_REPS_BEFORE_MATURE", 0)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	immatureMax, err := getenvInt("IMMATURE_MAX_INTERVAL_DAYS", 7)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if minReps < 0 || immatureMax < 1 {
+		return dbConfig{}, errors.New("MIN_REPS_BEFORE_MATURE must be >= 0 and IMMATURE_MAX_INTERVAL_DAYS >= 1")
+	}
+	dueCountTTL, err := getenvDuration("DUE_COUNT_CACHE_TTL", 30*time.Second)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	nextDueTTL, err := getenvDuration("NEXT_DUE_CACHE_TTL", 30*time.Second)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	gradeDebounce, err := getenvDuration("GRADE_DEBOUNCE", 2*time.Second)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	learnAhead, err := getenvDuration("LEARN_AHEAD", 20*time.Minute)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if learnAhead < 0 {
+		return dbConfig{}, errors.New("LEARN_AHEAD must not be negative")
+	}
+	newPerDay, err := getenvInt("NEW_CARDS_PER_DAY", 0)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	rampAfter, err := getenvInt("NEW_CARD_RAMP_AFTER_DAYS", 0)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	rampDays, err := getenvInt("NEW_CARD_RAMP_DAYS", 5)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if newPerDay < 0 || rampAfter < 0 || rampDays < 1 {
+		return dbConfig{}, errors.New("NEW_CARDS_PER_DAY and NEW_CARD_RAMP_AFTER_DAYS must be >= 0 and NEW_CARD_RAMP_DAYS >= 1")
+	}
+	queryTimeout, err := getenvDuration("DB_QUERY_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if queryTimeout <= 0 {
+		return dbConfig{}, errors.New("DB_QUERY_TIMEOUT must be positive")
+	}
+	poolMax, err := getenvInt("PGPOOL_MAX_CONNS", 0)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	poolMin, err := getenvInt("PGPOOL_MIN_CONNS", 0)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if poolMax < 0 || poolMin < 0 || (poolMax > 0 && poolMax < poolMin) {
+		return dbConfig{}, errors.New("PGPOOL_MAX_CONNS and PGPOOL_MIN_CONNS must be >= 0, with max >= min")
+	}
+	execMode, ok := queryExecModes[getenvDefault("PGX_EXEC_MODE", "cache_statement")]
+	if !ok {
+		return dbConfig{}, errors.New("PGX_EXEC_MODE must be cache_statement, cache_describe, describe_exec, exec or simple_protocol")
+	}
+	stmtCache, err := getenvInt("PGX_STATEMENT_CACHE_SIZE", 0)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if stmtCache < 0 {
+		return dbConfig{}, errors.New("PGX_STATEMENT_CACHE_SIZE must be >= 0")
+	}
+	connectRetries, err := getenvInt("DB_CONNECT_RETRIES", 5)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if connectRetries < 1 {
+		return dbConfig{}, errors.New("DB_CONNECT_RETRIES must be at least 1")
+	}
+	shutdownTimeout, err := getenvDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if shutdownTimeout <= 0 {
+		return dbConfig{}, errors.New("SHUTDOWN_TIMEOUT must be positive")
+	}
+	tokenTTL, err := getenvDuration("REVIEW_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	tokenSecret := []byte(os.Getenv("SESSION_SECRET"))
+	if len(tokenSecret) == 0 {
+		// Fine for a single process; serverless instances each get their
+		// own key, so tokens only verify on the instance that issued them.
+		slog.Warn("SESSION_SECRET not set, using a random per-process key")
+		tokenSecret = make([]byte, 32)
+		rand.Read(tokenSecret)
+	}
+	ttsURL := os.Getenv("TTS_URL")
+	if ttsURL != "" {
+		u, err := url.Parse(ttsURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return dbConfig{}, errors.New("TTS_URL must be an http or https URL")
+		}
+	}
+	params, err := loadFSRSParams()
+	if err != nil {
+		return dbConfig{}, err
+	}
+	leechThreshold, err := getenvInt("LEECH_THRESHOLD", 8)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	if leechThreshold < 0 {
+		return dbConfig{}, errors.New("LEECH_THRESHOLD must be >= 0")
+	}
+	leechSuspend, err := getenvBool("LEECH_SUSPEND", false)
+	if err != nil {
+		return dbConfig{}, err
+	}
+	order, err := parseReviewOrder(os.Getenv("REVIEW_ORDER"))
+	if err != nil {
+		return dbConfig{}, fmt.Errorf("invalid REVIEW_ORDER: %w", err)
+	}
+	buttons, err := parseGradeButtons(os.Getenv("GRADE_BUTTONS"))
+	if err != nil {
+		return dbConfig{}, fmt.Errorf("invalid GRADE_BUTTONS: %w", err)
+	}
+	timezone := time.UTC
+	if v := os.Getenv("APP_TIMEZONE"); v != "" {
+		if timezone, err = loadTimezone(v); err != nil {
+			return dbConfig{}, fmt.Errorf("invalid APP_TIMEZONE: %w", err)
+		}
+	} else if v := strings.TrimPrefix(os.Getenv("TZ"), ":"); v != "" {
+		// TZ is often set by the platform, sometimes to a file path,
+		// so an unusable value is not fatal.
+		if loc, err := loadTimezone(v); err == nil {
+			timezone = loc
+		} else {
+			slog.Warn("TZ is not an IANA zone name, counting days in UTC", "tz", v)
+		}
+	}
+	var logLevel slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := logLevel.UnmarshalText([]byte(v)); err != nil {
+			return dbConfig{}, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+		}
+	}
+	var apiKeys []string
+	for _, k := range strings.Split(os.Getenv("API_KEY")+","+os.Getenv("API_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			apiKeys = append(apiKeys, k)
+		}
+	}
+	if len(apiKeys) == 0 {
+		slog.Warn("API_KEY not set, every endpoint is open")
+	}
+	var aspects []string
+	if v := os.Getenv("ASPECTS"); v != "" {
+		for _, a := range strings.Split(v, ",") {
+			a = strings.TrimSpace(a)
+			if a == aspectRecognition {
+				continue
+			}
+			if !extraAspects[a] {
+				return dbConfig{}, fmt.Errorf("invalid ASPECTS: unknown aspect %q", a)
+			}
+			aspects = append(aspects, a)
+		}
+	}
 	return dbConfig{
-		Host:     host,
-		Port:     port,
-		User:     user,
-		Password: pass,
-		KairosDB: kairosDB,
-		SSLMode:  sslmode,
+		Host:            host,
+		Port:            port,
+		User:            user,
+		Password:        pass,
+		KairosDB:        kairosDB,
+		SSLMode:         sslmode,
+		ReplicaHost:     replicaHost,
+		ReplicaPort:     replicaPort,
+		DevMode:         devMode,
+		LogLevel:        logLevel,
+		RepairOnStartup: repair,
+		Aspects:         aspects,
+		LogReveals:      logReveals,
+
+		MigrateOnStartup:        migrateOnStartup,
+		MinRepsBeforeMature:     minReps,
+		ImmatureMaxIntervalDays: immatureMax,
+		DueCountCacheTTL:        dueCountTTL,
+		NextDueCacheTTL:         nextDueTTL,
+		GradeDebounce:           gradeDebounce,
+		LearnAhead:              learnAhead,
+		NewCardsPerDay:          newPerDay,
+		NewCardRampAfterDays:    rampAfter,
+		NewCardRampDays:         rampDays,
+		QueryTimeout:            queryTimeout,
+		PoolMaxConns:            poolMax,
+		PoolMinConns:            poolMin,
+		QueryExecMode:           execMode,
+		StatementCacheSize:      stmtCache,
+		ConnectRetries:          connectRetries,
+		ShutdownTimeout:         shutdownTimeout,
+		LeechThreshold:          leechThreshold,
+		LeechSuspend:            leechSuspend,
+		ReviewOrder:             order,
+		GradeButtons:            buttons,
+		Timezone:                timezone,
+		APIKeys:                 apiKeys,
+		UserHeader:              os.Getenv("USER_HEADER"),
+		TokenSecret:             tokenSecret,
+		TokenTTL:                tokenTTL,
+		TTSURL:                  ttsURL,
+		TTSKey:                  os.Getenv("TTS_API_KEY"),
+		FSRS:                    params,
 	}, nil
 }
 
@@ -141,25 +852,196 @@ func buildPostgresURL(cfg dbConfig, dbName string) (string, error) {
 	return u.String(), nil
 }
 
-func getNextDueCard(pool *pgxpool.Pool) (*Card, error) {
-	ctx := context.Background()
-	row := pool.QueryRow(ctx, nextDueQuery)
+// redactDSN is dsn with any password replaced by "***", for logging. A
+// DSN that doesn't parse as a URL is withheld entirely, as there is no
+// telling where its password is.
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "<unparseable dsn>"
+	}
+	// Redacted writes the password as "xxxxx"; the userinfo is escaped,
+	// so ":xxxxx@" can only be that.
+	return strings.Replace(u.Redacted(), ":xxxxx@", ":***@", 1)
+}
+
+// redactError scrubs secret, as written and as URL-escaped in a DSN, from
+// err's message. pgx already redacts the DSNs it echoes; this keeps a
+// password out of the logs whatever wraps it. Only an error that did
+// contain the secret loses its wrapped chain.
+func redactError(err error, secret string) error {
+	if err == nil || secret == "" {
+		return err
+	}
+	msg := err.Error()
+	escaped := strings.TrimPrefix(url.UserPassword("", secret).String(), ":")
+	if !strings.Contains(msg, secret) && !strings.Contains(msg, escaped) {
+		return err
+	}
+	msg = strings.ReplaceAll(msg, secret, "***")
+	return errors.New(strings.ReplaceAll(msg, escaped, "***"))
+}
+
+// String renders cfg for logs and errors with its secrets (the database
+// password, SESSION_SECRET, API keys, the TTS key and any password in
+// TTS_URL) replaced by "***".
+func (cfg dbConfig) String() string {
+	type plain dbConfig // drops the methods, so %+v doesn't recurse
+	c := plain(cfg)
+	if c.Password != "" {
+		c.Password = "***"
+	}
+	if c.TTSURL != "" {
+		c.TTSURL = redactDSN(c.TTSURL)
+	}
+	if len(c.TokenSecret) > 0 {
+		c.TokenSecret = []byte("***")
+	}
+	if c.TTSKey != "" {
+		c.TTSKey = "***"
+	}
+	c.APIKeys = make([]string, len(cfg.APIKeys))
+	for i := range c.APIKeys {
+		c.APIKeys[i] = "***"
+	}
+	return fmt.Sprintf("%+v", c)
+}
+
+// MarshalText makes JSON (and so the JSON log handler) use String.
+func (cfg dbConfig) MarshalText() ([]byte, error) {
+	return []byte(cfg.String()), nil
+}
+
+// debugConfig is the part of dbConfig /admin/debug shows: the settings
+// only, listed field by field so a secret added to dbConfig later stays
+// out until someone puts it here. Of the API keys only the count is
+// shown, and of the TTS service only whether it is on.
+type debugConfig struct {
+	Host                 string       `json:"host"`
+	Port                 string       `json:"port"`
+	User                 string       `json:"user"`
+	Database             string       `json:"database"`
+	SSLMode              string       `json:"sslmode"`
+	ReplicaHost          string       `json:"replica_host,omitempty"`
+	ReplicaPort          string       `json:"replica_port,omitempty"`
+	DevMode              bool         `json:"dev_mode"`
+	LogLevel             slog.Level   `json:"log_level"`
+	MigrateOnStartup     bool         `json:"migrate_on_startup"`
+	RepairOnStartup      bool         `json:"repair_on_startup"`
+	Aspects              []string     `json:"aspects"`
+	LogReveals           bool         `json:"log_reveals"`
+	MinRepsBeforeMature  int          `json:"min_reps_before_mature"`
+	ImmatureMaxInterval  int          `json:"immature_max_interval_days"`
+	DueCountCacheTTL     string       `json:"due_count_cache_ttl"`
+	NextDueCacheTTL      string       `json:"next_due_cache_ttl"`
+	GradeDebounce        string       `json:"grade_debounce"`
+	LearnAhead           string       `json:"learn_ahead"`
+	NewCardsPerDay       int          `json:"new_cards_per_day"`
+	NewCardRampAfterDays int          `json:"new_card_ramp_after_days"`
+	NewCardRampDays      int          `json:"new_card_ramp_days"`
+	QueryTimeout         string       `json:"query_timeout"`
+	PoolMaxConns         int          `json:"pool_max_conns"`
+	PoolMinConns         int          `json:"pool_min_conns"`
+	QueryExecMode        string       `json:"query_exec_mode"`
+	StatementCacheSize   int          `json:"statement_cache_size"`
+	ConnectRetries       int          `json:"connect_retries"`
+	ShutdownTimeout      string       `json:"shutdown_timeout"`
+	APIKeys              int          `json:"api_keys"`
+	LeechThreshold       int          `json:"leech_threshold"`
+	LeechSuspend         bool         `json:"leech_suspend"`
+	Timezone             string       `json:"timezone"`
+	ReviewOrder          reviewOrder  `json:"review_order"`
+	GradeButtons         gradeButtons `json:"grade_buttons"`
+	UserHeader           string       `json:"user_header,omitempty"`
+	TokenTTL             string       `json:"review_token_ttl"`
+	TTS                  bool         `json:"tts"`
+	DesiredRetention     float64      `json:"desired_retention"`
+	Weights              fsrs.Weights `json:"weights"`
+	MaximumInterval      float64      `json:"maximum_interval"`
+}
+
+func (cfg dbConfig) debug() debugConfig {
+	return debugConfig{
+		Host:                 cfg.Host,
+		Port:                 cfg.Port,
+		User:                 cfg.User,
+		Database:             cfg.KairosDB,
+		SSLMode:              cfg.SSLMode,
+		ReplicaHost:          cfg.ReplicaHost,
+		ReplicaPort:          cfg.ReplicaPort,
+		DevMode:              cfg.DevMode,
+		LogLevel:             cfg.LogLevel,
+		MigrateOnStartup:     cfg.MigrateOnStartup,
+		RepairOnStartup:      cfg.RepairOnStartup,
+		Aspects:              cfg.Aspects,
+		LogReveals:           cfg.LogReveals,
+		MinRepsBeforeMature:  cfg.MinRepsBeforeMature,
+		ImmatureMaxInterval:  cfg.ImmatureMaxIntervalDays,
+		DueCountCacheTTL:     cfg.DueCountCacheTTL.String(),
+		NextDueCacheTTL:      cfg.NextDueCacheTTL.String(),
+		GradeDebounce:        cfg.GradeDebounce.String(),
+		LearnAhead:           cfg.LearnAhead.String(),
+		NewCardsPerDay:       cfg.NewCardsPerDay,
+		NewCardRampAfterDays: cfg.NewCardRampAfterDays,
+		NewCardRampDays:      cfg.NewCardRampDays,
+		QueryTimeout:         cfg.QueryTimeout.String(),
+		PoolMaxConns:         cfg.PoolMaxConns,
+		PoolMinConns:         cfg.PoolMinConns,
+		QueryExecMode:        cfg.QueryExecMode.String(),
+		StatementCacheSize:   cfg.StatementCacheSize,
+		ConnectRetries:       cfg.ConnectRetries,
+		ShutdownTimeout:      cfg.ShutdownTimeout.String(),
+		APIKeys:              len(cfg.APIKeys),
+		LeechThreshold:       cfg.LeechThreshold,
+		LeechSuspend:         cfg.LeechSuspend,
+		Timezone:             cfg.Timezone.String(),
+		ReviewOrder:          cfg.ReviewOrder,
+		GradeButtons:         cfg.GradeButtons,
+		UserHeader:           cfg.UserHeader,
+		TokenTTL:             cfg.TokenTTL.String(),
+		TTS:                  cfg.TTSURL != "",
+		DesiredRetention:     cfg.FSRS.RequestRetention,
+		Weights:              cfg.FSRS.W,
+		MaximumInterval:      cfg.FSRS.MaximumInterval,
+	}
+}
+
+// newQueryTracer logs every statement with its (truncated) args and duration
+// at debug level. Only wired up in dev mode: args may contain user data and
+// the per-query overhead is not worth paying in production.
+func newQueryTracer(logger *slog.Logger) pgx.QueryTracer {
+	return &tracelog.TraceLog{
+		Logger: tracelog.LoggerFunc(func(ctx context.Context, _ tracelog.LogLevel, msg string, data map[string]any) {
+			attrs := make([]slog.Attr, 0, len(data))
+			for k, v := range data {
+				attrs = append(attrs, slog.Any(k, v))
+			}
+			logger.LogAttrs(ctx, slog.LevelDebug, msg, attrs...)
+		}),
+		LogLevel: tracelog.LogLevelInfo,
+		Config:   &tracelog.TraceLogConfig{TimeKey: "duration"},
+	}
+}
+
+// scanCard reads one row of cardQuery's column list. It returns nil, nil
+// when the row does not exist.
+func scanCard(row pgx.Row) (*Card, error) {
 	var c Card
-	err := row.Scan(&c.Headword, &c.Pinyin, &c.EnDef, &c.ZhDef, &c.Freq, &c.Stability, &c.Difficulty, &c.Lapses, &c.State, &c.LastReview, &c.Due, &c.Reps)
+	err := row.Scan(&c.Headword, &c.Pinyin, &c.EnDef, &c.ZhDef, &c.Freq, &c.ExampleZh, &c.ExampleEn, &c.HSK, &c.Tags, &c.DesiredRetention, &c.Stability, &c.Difficulty, &c.Lapses, &c.State, &c.LastReview, &c.Due, &c.Reps, &c.Suspended, &c.Version)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
+	c.Aspect = aspectRecognition
 	return &c, nil
 }
 
-func getCardByHeadword(pool *pgxpool.Pool, headword string) (*Card, error) {
-	ctx := context.Background()
-	row := pool.QueryRow(ctx, byHeadwordQuery, headword)
+// scanAspectCard reads one row of aspectCardQuery's column list.
+func scanAspectCard(row pgx.Row) (*Card, error) {
 	var c Card
-	err := row.Scan(&c.Headword, &c.Pinyin, &c.EnDef, &c.ZhDef, &c.Freq, &c.Stability, &c.Difficulty, &c.Lapses, &c.State, &c.LastReview, &c.Due, &c.Reps)
+	err := row.Scan(&c.Headword, &c.Pinyin, &c.EnDef, &c.ZhDef, &c.Freq, &c.ExampleZh, &c.ExampleEn, &c.HSK, &c.Tags, &c.DesiredRetention, &c.Stability, &c.Difficulty, &c.Lapses, &c.State, &c.LastReview, &c.Due, &c.Reps, &c.Suspended, &c.Aspect, &c.Version)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -169,168 +1051,6976 @@ func getCardByHeadword(pool *pgxpool.Pool, headword string) (*Card, error) {
 	return &c, nil
 }
 
-func updateCardInDB(pool *pgxpool.Pool, c Card) error {
-	const updateSQL = `
-update entries set
-stability = $1,
-difficulty = $2,
-lapses = $3,
-state = $4,
-last_review = $5,
-due_at = $6,
-reps_ct = $7
-where headword = $8
-`
-	_, err := pool.Exec(context.Background(), updateSQL,
-		c.Stability,
-		c.Difficulty,
-		c.Lapses,
-		c.State,
-		c.LastReview,
-		c.Due,
-		c.Reps,
-		c.Headword,
-	)
-	return err
+func scanCards(rows pgx.Rows) ([]Card, error) {
+	defer rows.Close()
+	cards := []Card{}
+	for rows.Next() {
+		c, err := scanCard(rows)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, *c)
+	}
+	return cards, rows.Err()
 }
 
-func (app *application) handleReview(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	card, err := getNextDueCard(app.db)
-	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
+// reviewOrder picks how the next due card is chosen. Each order maps to
+// fixed queries below; user input only ever selects one of them.
+type reviewOrder string
+
+const (
+	orderDue    reviewOrder = "due"
+	orderFreq   reviewOrder = "freq"
+	orderRandom reviewOrder = "random"
+)
+
+var (
+	nextDueQueries = map[reviewOrder]string{
+		orderDue:    nextDueQuery,
+		orderFreq:   nextDueFreqQuery,
+		orderRandom: nextDueRandomQuery,
 	}
-	if card == nil {
-		w.Write([]byte("<h1>All cards reviewed!</h1>"))
-		return
+	nextDueAspectQueries = map[reviewOrder]string{
+		orderDue:    nextDueAspectQuery,
+		orderFreq:   nextDueAspectFreqQuery,
+		orderRandom: nextDueAspectRandomQuery,
 	}
-	if err := app.tmpl.ExecuteTemplate(w, "front.html", card); err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
+	// The claim variants lock the row they return and pass over rows
+	// another transaction holds, so concurrent fetches inside
+	// transactions each get a different card.
+	claimNextDueQueries       = withSuffix(nextDueQueries, ` for update skip locked`)
+	claimNextDueAspectQueries = withSuffix(nextDueAspectQueries, ` for update of a skip locked`)
+)
+
+func withSuffix(queries map[reviewOrder]string, suffix string) map[reviewOrder]string {
+	out := make(map[reviewOrder]string, len(queries))
+	for order, q := range queries {
+		out[order] = q + suffix
 	}
+	return out
 }
 
-func (app *application) handleReveal(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// gradeButtons is which ratings the review page offers. Two-button mode
+// keeps Again and Good only; API clients may still send any rating.
+type gradeButtons string
+
+const (
+	buttonsFour gradeButtons = "four"
+	buttonsTwo  gradeButtons = "two"
+)
+
+// parseGradeButtons validates s; "" is buttonsFour.
+func parseGradeButtons(s string) (gradeButtons, error) {
+	switch b := gradeButtons(s); b {
+	case "":
+		return buttonsFour, nil
+	case buttonsFour, buttonsTwo:
+		return b, nil
 	}
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Form parse error", http.StatusBadRequest)
-		return
+	return "", fmt.Errorf("unknown grade buttons %q (want four or two)", s)
+}
+
+// ratings returns the ratings b shows, in button order.
+func (b gradeButtons) ratings() []fsrs.Rating {
+	if b == buttonsTwo {
+		return []fsrs.Rating{fsrs.Again, fsrs.Good}
 	}
-	headword := r.FormValue("front")
-	if headword == "" {
-		http.Redirect(w, r, "/review", http.StatusSeeOther)
-		return
+	return []fsrs.Rating{fsrs.Again, fsrs.Hard, fsrs.Good, fsrs.Easy}
+}
+
+// ratingChoices describes b's ratings for error messages and prompts:
+// "1 (Again) or 3 (Good)".
+func (b gradeButtons) ratingChoices() string {
+	var parts []string
+	for _, g := range b.ratings() {
+		parts = append(parts, fmt.Sprintf("%d (%s)", g, g))
 	}
-	card, err := getCardByHeadword(app.db, headword)
-	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
+	return strings.Join(parts[:len(parts)-1], ", ") + " or " + parts[len(parts)-1]
+}
+
+// parseReviewOrder validates s against the known orders; "" is orderDue.
+func parseReviewOrder(s string) (reviewOrder, error) {
+	if s == "" {
+		return orderDue, nil
 	}
-	if card == nil {
-		http.Redirect(w, r, "/review", http.StatusSeeOther)
-		return
+	if _, ok := nextDueQueries[reviewOrder(s)]; !ok {
+		return "", fmt.Errorf("unknown review order %q (want due, freq or random)", s)
 	}
-	if err := app.tmpl.ExecuteTemplate(w, "back.html", card); err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
+	return reviewOrder(s), nil
+}
+
+// maxHSKLevel is the top band of HSK 3.0.
+const maxHSKLevel = 9
+
+// parseHSKLevel validates a ?hsk= value; "" is 0, meaning any level.
+func parseHSKLevel(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxHSKLevel {
+		return 0, fmt.Errorf("hsk level %q out of range 1..%d", s, maxHSKLevel)
+	}
+	return n, nil
+}
+
+// queueFilter narrows the review queue. The zero value is the whole deck.
+type queueFilter struct {
+	HSK int    // HSK level, 0 for any
+	Tag string // tag, "" for any
+	// NoNew holds back New cards once the day's new-card limit is used
+	// up; nextDue sets it, and NextDueAt and LearnAhead ignore it.
+	NoNew bool
+}
+
+// maxTagLen bounds a tag's length in runes.
+const maxTagLen = 50
+
+// parseTag normalizes a tag to lower case without surrounding space and
+// checks it is usable in a comma-separated list; "" stays "".
+func parseTag(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case strings.ContainsAny(s, ","):
+		return "", errors.New("must not contain commas")
+	case utf8.RuneCountInString(s) > maxTagLen:
+		return "", fmt.Errorf("must be at most %d characters", maxTagLen)
+	}
+	return s, nil
+}
+
+// getNextDueCard returns the next card due at now in order among those f
+// lets through. now is passed in rather than taken from the database
+// clock so it can be pinned. With claim, db must be a transaction: the
+// card stays locked until it ends, and cards claimed by other
+// transactions are skipped.
+func getNextDueCard(ctx context.Context, db dbtx, order reviewOrder, now time.Time, f queueFilter, claim bool) (*Card, error) {
+	queries := nextDueQueries
+	if claim {
+		queries = claimNextDueQueries
+	}
+	return scanCard(db.QueryRow(ctx, queries[order], userID(ctx), now, f.HSK, f.Tag, f.NoNew))
+}
+
+// getLearnAheadCard returns the Learning or Relearning card due soonest
+// by until among those f lets through; claim is as for getNextDueCard.
+func getLearnAheadCard(ctx context.Context, db dbtx, until time.Time, f queueFilter, claim bool) (*Card, error) {
+	q := learnAheadQuery
+	if claim {
+		q += ` for update skip locked`
+	}
+	return scanCard(db.QueryRow(ctx, q, userID(ctx), until, f.HSK, f.Tag))
+}
+
+func getLearnAheadAspectCard(ctx context.Context, db dbtx, aspects []string, until time.Time, f queueFilter, claim bool) (*Card, error) {
+	q := learnAheadAspectQuery
+	if claim {
+		q += ` for update of a skip locked`
+	}
+	return scanAspectCard(db.QueryRow(ctx, q, userID(ctx), aspects, until, f.HSK, f.Tag))
+}
+
+func getCardByHeadword(ctx context.Context, db dbtx, headword string) (*Card, error) {
+	return scanCard(db.QueryRow(ctx, byHeadwordQuery, userID(ctx), headword))
+}
+
+func getCramCard(ctx context.Context, db dbtx, pos int) (*Card, error) {
+	return scanCard(db.QueryRow(ctx, cramQuery, userID(ctx), pos))
+}
+
+func getNextDueAspectCard(ctx context.Context, db dbtx, aspects []string, order reviewOrder, now time.Time, f queueFilter, claim bool) (*Card, error) {
+	queries := nextDueAspectQueries
+	if claim {
+		queries = claimNextDueAspectQueries
+	}
+	return scanAspectCard(db.QueryRow(ctx, queries[order], userID(ctx), aspects, now, f.HSK, f.Tag, f.NoNew))
+}
+
+func getAspectCard(ctx context.Context, db dbtx, headword, aspect string) (*Card, error) {
+	return scanAspectCard(db.QueryRow(ctx, byHeadwordAspectQuery, userID(ctx), headword, aspect))
+}
+
+// seedAspects creates a New schedule row for every entry missing one of the
+// given aspects, so enabling an aspect brings the whole deck into its queue.
+// It runs at startup and covers every user's deck.
+func seedAspects(ctx context.Context, pool *pgxpool.Pool, aspects []string) error {
+	_, err := pool.Exec(ctx, `
+insert into card_aspects (user_id, headword, aspect)
+select e.user_id, e.headword, a.aspect from entries e cross join unnest($1::text[]) as a(aspect)
+on conflict do nothing
+`, aspects)
+	return err
+}
+
+// pinyinKeySQL normalizes a pinyin column the way pinyinKey normalizes a
+// query: tone marks folded to the bare vowel, ü (or CEDICT's u:) as v, ê
+// (as in ê̄/ế/ề) as e, and tone numbers, spaces and apostrophes dropped, so
+// "nǐ hǎo", "ni3 hao3", "nihao" and "xī'ān"/"xian" all compare equal.
+const pinyinKeySQL = `regexp_replace(translate(replace(lower(pinyin), 'u:', 'v'), 'āáǎàēéěèīíǐìōóǒòūúǔùǖǘǚǜüêếề', 'aaaaeeeeiiiioooouuuuvvvvveee'), '[0-9\s''\u0304\u030c]', '', 'g')`
+
+var pinyinFold = strings.NewReplacer(
+	"u:", "v", "ü", "v", "ǖ", "v", "ǘ", "v", "ǚ", "v", "ǜ", "v",
+	"ā", "a", "á", "a", "ǎ", "a", "à", "a",
+	"ē", "e", "é", "e", "ě", "e", "è", "e",
+	"ī", "i", "í", "i", "ǐ", "i", "ì", "i",
+	"ō", "o", "ó", "o", "ǒ", "o", "ò", "o",
+	"ū", "u", "ú", "u", "ǔ", "u", "ù", "u",
+	"ê", "e", "ế", "e", "ề", "e",
+)
+
+// pinyinKey is the Go side of pinyinKeySQL.
+func pinyinKey(s string) string {
+	s = pinyinFold.Replace(strings.ToLower(s))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || unicode.IsSpace(r) || r == '\'' || r == '\u0304' || r == '\u030c' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// cardSorts are the orderings /cards can list the deck in, keyed by the
+// ?sort= value. Each ends on headword so pages never overlap.
+var cardSorts = map[string]string{
+	"freq":       `coalesce(freq, 0) desc, headword`,
+	"headword":   `headword`,
+	"due":        `due_at, headword`,
+	"difficulty": `difficulty desc, headword`,
+	"stability":  `stability desc, headword`,
+	"lapses":     `lapses desc, headword`,
+}
+
+// listCards returns one page of the deck in a cardSorts order, and the
+// size of the whole deck. A non-empty tag limits both to cards with it.
+func listCards(ctx context.Context, db dbtx, sort, tag string, limit, offset int) ([]Card, int, error) {
+	const where = ` where user_id = $1 and deleted_at is null and ($2::text = '' or $2 = any(tags))`
+	var total int
+	if err := db.QueryRow(ctx, `select count(*) from entries`+where, userID(ctx), tag).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query(ctx, cardQuery+where+` order by `+cardSorts[sort]+` limit $3 offset $4`, userID(ctx), tag, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	cards, err := scanCards(rows)
+	return cards, total, err
+}
+
+// updateTags sets a card's tags to expr, an expression over the current
+// tags and $3, and returns the result; ok is false when there is no such
+// card.
+func updateTags(ctx context.Context, db dbtx, headword, expr string, tags []string) (_ []string, ok bool, err error) {
+	var out []string
+	err = db.QueryRow(ctx, `update entries set tags = `+expr+` where user_id = $1 and headword = $2 and deleted_at is null returning tags`, userID(ctx), headword, tags).Scan(&out)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	}
+	return out, err == nil, err
+}
+
+// tagCount is one tag with how many cards carry it and how many of those
+// are due, suspended ones aside.
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+	Due   int    `json:"due"`
+}
+
+// getTags lists every tag in use, most used first, with its card counts
+// at now.
+func getTags(ctx context.Context, pool *pgxpool.Pool, now time.Time) ([]tagCount, error) {
+	rows, err := pool.Query(ctx, `
+select t, count(*), count(*) filter (where due_at <= $2 and not suspended)
+from entries, unnest(tags) t
+where user_id = $1 and deleted_at is null
+group by t
+order by count(*) desc, t
+`, userID(ctx), now)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[tagCount])
+}
+
+// searchCards finds up to limit cards whose headword contains q
+// (case-insensitively) or whose pinyin contains it ignoring tones. Exact
+// headword matches come first, then the most frequent.
+func searchCards(ctx context.Context, db dbtx, q string, limit int) ([]Card, error) {
+	pattern := "%" + likeEscaper.Replace(q) + "%"
+	key := "%" + likeEscaper.Replace(pinyinKey(q)) + "%"
+	rows, err := db.Query(ctx, cardQuery+`
+where user_id = $1 and deleted_at is null and (headword ilike $2 or ($3 <> '%%' and `+pinyinKeySQL+` like $3))
+order by headword = $4 desc, coalesce(freq, 0) desc, headword
+limit $5`, userID(ctx), pattern, key, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanCards(rows)
+}
+
+// searchDefinitionsSQL matches q against definition_tsv, stemmed as English
+// or taken word for word, best ts_rank first. plainto_tsquery treats q as
+// plain words, so operators or stray punctuation in it cannot make the
+// query fail.
+const searchDefinitionsSQL = `
+with q as (select plainto_tsquery('english', $2) || plainto_tsquery('simple', $2) as query)
+` + cardQuery + `, q
+where user_id = $1 and deleted_at is null and definition_tsv @@ q.query
+order by ts_rank(definition_tsv, q.query) desc, coalesce(freq, 0) desc, headword
+limit $3`
+
+// searchDefinitions finds up to limit cards whose English or Chinese
+// definition contains the words of q.
+func searchDefinitions(ctx context.Context, db dbtx, q string, limit int) ([]Card, error) {
+	rows, err := db.Query(ctx, searchDefinitionsSQL, userID(ctx), q, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanCards(rows)
+}
+
+func getFreqNeighbors(ctx context.Context, pool *pgxpool.Pool, headword string, window int) ([]Card, error) {
+	rows, err := pool.Query(ctx, neighborsQuery, userID(ctx), headword, window)
+	if err != nil {
+		return nil, err
+	}
+	return scanCards(rows)
+}
+
+type deckInfo struct {
+	Total         int        `json:"total"`
+	Due           int        `json:"due"`
+	EarliestDueAt *time.Time `json:"earliest_due_at"`
+	LatestDueAt   *time.Time `json:"latest_due_at"`
+}
+
+func getDeckInfo(ctx context.Context, pool *pgxpool.Pool, now time.Time) (deckInfo, error) {
+	const infoSQL = `
+select
+count(*),
+count(*) filter (where $2 >= due_at and not suspended),
+min(due_at),
+max(due_at)
+from entries
+where user_id = $1 and deleted_at is null
+`
+	var d deckInfo
+	err := pool.QueryRow(ctx, infoSQL, userID(ctx), now).Scan(&d.Total, &d.Due, &d.EarliestDueAt, &d.LatestDueAt)
+	return d, err
+}
+
+type deckStats struct {
+	Total         int     `json:"total"`
+	New           int     `json:"new"`
+	Learning      int     `json:"learning"`
+	Review        int     `json:"review"`
+	Relearning    int     `json:"relearning"`
+	DueNow        int     `json:"due_now"`
+	DueNext24h    int     `json:"due_next_24h"`
+	AvgStability  float64 `json:"avg_stability"`
+	AvgDifficulty float64 `json:"avg_difficulty"`
+}
+
+// getDeckStats computes the /stats summary in one pass over entries. The
+// averages only cover cards that have been reviewed; new cards carry
+// placeholder zeros that would drag them down. Due counts are as of now.
+func getDeckStats(ctx context.Context, pool *pgxpool.Pool, now time.Time) (deckStats, error) {
+	const statsSQL = `
+select
+count(*),
+count(*) filter (where state = 0),
+count(*) filter (where state = 1),
+count(*) filter (where state = 2),
+count(*) filter (where state = 3),
+count(*) filter (where $2 >= due_at and not suspended),
+count(*) filter (where due_at > $2 and due_at <= $2 + interval '24 hours' and not suspended),
+coalesce(avg(stability) filter (where state <> 0), 0),
+coalesce(avg(difficulty) filter (where state <> 0), 0)
+from entries
+where user_id = $1 and deleted_at is null
+`
+	var st deckStats
+	err := pool.QueryRow(ctx, statsSQL, userID(ctx), now).Scan(
+		&st.Total, &st.New, &st.Learning, &st.Review, &st.Relearning,
+		&st.DueNow, &st.DueNext24h, &st.AvgStability, &st.AvgDifficulty,
+	)
+	return st, err
+}
+
+// hskStats is one row of the /stats per-level breakdown. Level 0 collects
+// the cards with no HSK level.
+type hskStats struct {
+	Level  int `json:"level"`
+	Total  int `json:"total"`
+	New    int `json:"new"`
+	DueNow int `json:"due_now"`
+}
+
+// getHSKStats counts cards per HSK level, lowest level first and unlevelled
+// cards last, with those due as of now.
+func getHSKStats(ctx context.Context, pool *pgxpool.Pool, now time.Time) ([]hskStats, error) {
+	const hskSQL = `
+select
+coalesce(hsk_level, 0),
+count(*),
+count(*) filter (where state = 0),
+count(*) filter (where $2 >= due_at and not suspended)
+from entries
+where user_id = $1 and deleted_at is null
+group by 1
+order by 1 = 0, 1
+`
+	rows, err := pool.Query(ctx, hskSQL, userID(ctx), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	levels := []hskStats{}
+	for rows.Next() {
+		var h hskStats
+		if err := rows.Scan(&h.Level, &h.Total, &h.New, &h.DueNow); err != nil {
+			return nil, err
+		}
+		levels = append(levels, h)
+	}
+	return levels, rows.Err()
+}
+
+type forecastDay struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+	// Pct is Count relative to the busiest day, for the bar chart.
+	Pct int `json:"-"`
+}
+
+// getForecast counts cards coming due on each of the next days days,
+// bucketed by calendar day in loc, starting from the day of now. Cards
+// that are already overdue count towards today.
+func getForecast(ctx context.Context, pool *pgxpool.Pool, days int, loc *time.Location, now time.Time) ([]forecastDay, error) {
+	// d is local midnight as a timestamp without time zone; d at time
+	// zone $3 is the instant it happens.
+	const forecastSQL = `
+select d::date, count(e.headword)
+from generate_series(date_trunc('day', $4::timestamptz at time zone $3), date_trunc('day', $4::timestamptz at time zone $3) + ($1 - 1) * interval '1 day', interval '1 day') as d
+left join entries e on e.user_id = $2 and not e.suspended and e.deleted_at is null
+and greatest(e.due_at, $4::timestamptz) >= d at time zone $3
+and greatest(e.due_at, $4::timestamptz) < (d + interval '1 day') at time zone $3
+group by d
+order by d
+`
+	rows, err := pool.Query(ctx, forecastSQL, days, userID(ctx), loc.String(), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	forecast := []forecastDay{}
+	busiest := 0
+	for rows.Next() {
+		var (
+			d time.Time
+			n int
+		)
+		if err := rows.Scan(&d, &n); err != nil {
+			return nil, err
+		}
+		forecast = append(forecast, forecastDay{Date: d.Format(time.DateOnly), Count: n})
+		busiest = max(busiest, n)
+	}
+	if busiest > 0 {
+		for i := range forecast {
+			forecast[i].Pct = forecast[i].Count * 100 / busiest
+		}
+	}
+	return forecast, rows.Err()
+}
+
+type heatmapDay struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// getHeatmap counts reviews on each of the last days days in loc, the day
+// of now included, oldest first. Days without reviews are present with a
+// zero count, so the series is dense.
+func getHeatmap(ctx context.Context, pool *pgxpool.Pool, days int, loc *time.Location, now time.Time) ([]heatmapDay, error) {
+	const heatmapSQL = `
+select d::date, count(l.id)
+from generate_series(date_trunc('day', $4::timestamptz at time zone $3) - ($1 - 1) * interval '1 day', date_trunc('day', $4::timestamptz at time zone $3), interval '1 day') as d
+left join review_log l on l.user_id = $2
+and l.reviewed_at >= d at time zone $3
+and l.reviewed_at < (d + interval '1 day') at time zone $3
+group by d
+order by d
+`
+	rows, err := pool.Query(ctx, heatmapSQL, days, userID(ctx), loc.String(), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	heatmap := make([]heatmapDay, 0, days)
+	for rows.Next() {
+		var (
+			d time.Time
+			n int
+		)
+		if err := rows.Scan(&d, &n); err != nil {
+			return nil, err
+		}
+		heatmap = append(heatmap, heatmapDay{Date: d.Format(time.DateOnly), Count: n})
+	}
+	return heatmap, rows.Err()
+}
+
+// reviewDays returns the distinct calendar days in loc on which any card
+// was reviewed, oldest first, each as midnight UTC of that date.
+func reviewDays(ctx context.Context, db dbtx, loc *time.Location) ([]time.Time, error) {
+	rows, err := db.Query(ctx, `
+select distinct (reviewed_at at time zone $2)::date
+from review_log
+where user_id = $1
+order by 1
+`, userID(ctx), loc.String())
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[time.Time])
+}
+
+type hourBucket struct {
+	Hour  int `json:"hour"`
+	Count int `json:"count"`
+	// Pct is Count relative to the busiest hour, for the bar chart.
+	Pct int `json:"-"`
+}
+
+type weekdayBucket struct {
+	Weekday time.Weekday `json:"weekday"` // 0 is Sunday
+	Name    string       `json:"name"`
+	Count   int          `json:"count"`
+	// Pct is Count relative to the busiest weekday, for the bar chart.
+	Pct int `json:"-"`
+}
+
+// reviewPatterns is when reviews happen: every review ever logged,
+// counted by hour of the day and by day of the week in TZ.
+type reviewPatterns struct {
+	TZ        string          `json:"tz"`
+	ByHour    []hourBucket    `json:"by_hour"`
+	ByWeekday []weekdayBucket `json:"by_weekday"`
+}
+
+// getReviewPatterns builds reviewPatterns in loc. Every hour 0-23 and
+// weekday 0-6 is present, with a zero count if nothing was reviewed then.
+func getReviewPatterns(ctx context.Context, pool *pgxpool.Pool, loc *time.Location) (*reviewPatterns, error) {
+	// t is reviewed_at as a wall-clock time in loc, so extract reads the
+	// local hour and weekday, daylight saving included.
+	const patternsSQL = `
+with l as (
+    select reviewed_at at time zone $2 as t from review_log where user_id = $1
+)
+select 'hour', h, count(l.t)
+from generate_series(0, 23) as h left join l on extract(hour from l.t) = h
+group by h
+union all
+select 'dow', d, count(l.t)
+from generate_series(0, 6) as d left join l on extract(dow from l.t) = d
+group by d
+order by 1 desc, 2
+`
+	rows, err := pool.Query(ctx, patternsSQL, userID(ctx), loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	p := &reviewPatterns{TZ: loc.String(), ByHour: make([]hourBucket, 0, 24), ByWeekday: make([]weekdayBucket, 0, 7)}
+	busiestHour, busiestDay := 0, 0
+	for rows.Next() {
+		var (
+			kind  string
+			at, n int
+		)
+		if err := rows.Scan(&kind, &at, &n); err != nil {
+			return nil, err
+		}
+		if kind == "hour" {
+			p.ByHour = append(p.ByHour, hourBucket{Hour: at, Count: n})
+			busiestHour = max(busiestHour, n)
+		} else {
+			p.ByWeekday = append(p.ByWeekday, weekdayBucket{Weekday: time.Weekday(at), Name: time.Weekday(at).String(), Count: n})
+			busiestDay = max(busiestDay, n)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if busiestHour > 0 {
+		for i := range p.ByHour {
+			p.ByHour[i].Pct = p.ByHour[i].Count * 100 / busiestHour
+		}
+	}
+	if busiestDay > 0 {
+		for i := range p.ByWeekday {
+			p.ByWeekday[i].Pct = p.ByWeekday[i].Count * 100 / busiestDay
+		}
+	}
+	return p, nil
+}
+
+// streaks measures runs of consecutive days in days, which must be
+// sorted, distinct and at midnight UTC like today. The current streak is
+// the run ending today or yesterday, since today's reviews may still be
+// to come; longest is the longest run ever.
+func streaks(days []time.Time, today time.Time) (current, longest int) {
+	run := 0
+	for i, d := range days {
+		if i > 0 && d.Equal(days[i-1].AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		longest = max(longest, run)
+	}
+	if n := len(days); n > 0 && !days[n-1].Before(today.AddDate(0, 0, -1)) {
+		current = run
+	}
+	return current, longest
+}
+
+// countIntroduced counts the New cards graded since since, each aspect
+// a card of its own, as the queue introduces them.
+func countIntroduced(ctx context.Context, db dbtx, since time.Time) (int, error) {
+	var n int
+	err := db.QueryRow(ctx, `select count(*) from review_log where user_id = $1 and old_state = 0 and reviewed_at >= $2`, userID(ctx), since).Scan(&n)
+	return n, err
+}
+
+// newCardLimit is the day's new-card limit under s: newPerDay, or less
+// while easing back in after a break. days are the dates with reviews and
+// today is today's, as streaks takes them. A break is more than rampAfter
+// days without a review; counting the first day back as day 0, day k
+// allows (k+1)/(rampDays+1) of newPerDay, never less than one card, and
+// day rampDays is back to the full limit. A deck with no reviews before
+// has had no break.
+func (s *scheduling) newCardLimit(days []time.Time, today time.Time) int {
+	if s.newPerDay == 0 || s.rampAfter == 0 || len(days) == 0 {
+		return s.newPerDay
+	}
+	if !days[len(days)-1].Equal(today) {
+		days = append(slices.Clip(days), today)
+	}
+	for i := len(days) - 1; i > 0; i-- {
+		k := wholeDays(today.Sub(days[i]))
+		if k >= uint64(s.rampDays) {
+			break
+		}
+		if wholeDays(days[i].Sub(days[i-1])) > uint64(s.rampAfter) {
+			return max(s.newPerDay*(int(k)+1)/(s.rampDays+1), 1)
+		}
+	}
+	return s.newPerDay
+}
+
+// errCardExists is returned by insertCard when the headword is taken,
+// including by a card in the trash.
+var errCardExists = errors.New("card already exists")
+
+// insertCard adds c as a new card due at now, its creation time, along
+// with a schedule row for each enabled extra aspect. last_review starts at
+// now too; mapToFSRS ignores it while the card is New.
+func insertCard(ctx context.Context, db txBeginner, c Card, aspects []string, now time.Time) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `
+insert into entries (
+user_id, headword, pinyin, english_definition, chinese_definition, freq,
+example_sentence_zh, example_sentence_en, hsk_level, desired_retention,
+stability, difficulty, lapses, state, last_review, due_at, reps_ct
+) values ($1, $2, $3, $4, $5, $6, nullif($7, ''), nullif($8, ''), nullif($9::int, 0), $10, 0, 0, 0, 0, $11, $11, 0)
+on conflict (user_id, headword) do nothing
+`, userID(ctx), c.Headword, c.Pinyin, c.EnDef, c.ZhDef, c.Freq, c.ExampleZh, c.ExampleEn, c.HSK, c.DesiredRetention, now)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errCardExists
+	}
+	if len(aspects) > 0 {
+		_, err := tx.Exec(ctx, `insert into card_aspects (user_id, headword, aspect, last_review, due_at) select $1, $2, unnest($3::text[]), $4, $4`, userID(ctx), c.Headword, aspects, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// updateCardContent writes the definition fields and desired retention of
+// c. It never touches the scheduling columns, so an edit cannot disturb a
+// card's FSRS state; a new retention applies from the next grade.
+func updateCardContent(ctx context.Context, db dbtx, c Card) error {
+	const updateSQL = `
+update entries set
+pinyin = $1,
+english_definition = $2,
+chinese_definition = $3,
+freq = $4,
+example_sentence_zh = nullif($5, ''),
+example_sentence_en = nullif($6, ''),
+hsk_level = nullif($9::int, 0),
+desired_retention = $10
+where user_id = $7 and headword = $8 and deleted_at is null
+`
+	_, err := db.Exec(ctx, updateSQL, c.Pinyin, c.EnDef, c.ZhDef, c.Freq, c.ExampleZh, c.ExampleEn, userID(ctx), c.Headword, c.HSK, c.DesiredRetention)
+	return err
+}
+
+// importColumns is the header a CSV import must start with.
+var importColumns = []string{"headword", "pinyin", "english_definition", "chinese_definition", "freq"}
+
+// importBatchSize is how many rows importCSV sends per round trip.
+const importBatchSize = 500
+
+// maxImportErrors caps the row errors an import reports back.
+const maxImportErrors = 100
+
+// errBadCSV marks an import file that is not a CSV of importColumns.
+var errBadCSV = errors.New("malformed CSV")
+
+type importRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// importReport summarises a CSV import. Errors lists the first
+// maxImportErrors rejected rows; Errored counts all of them.
+type importReport struct {
+	Inserted int              `json:"inserted"`
+	Updated  int              `json:"updated"`
+	Skipped  int              `json:"skipped"`
+	Errored  int              `json:"errored"`
+	Errors   []importRowError `json:"errors"`
+}
+
+func (rep *importReport) reject(line int, msg string) {
+	rep.Errored++
+	if len(rep.Errors) < maxImportErrors {
+		rep.Errors = append(rep.Errors, importRowError{Line: line, Error: msg})
+	}
+}
+
+// importCardSQL inserts one imported card as New and due at $9, with a
+// schedule row for each enabled extra aspect ($8). On a duplicate headword
+// it overwrites the content columns when $7 is true and otherwise leaves
+// the card alone; the schedule is never touched. It returns one row,
+// whether the card was inserted, unless the duplicate was skipped.
+const importCardSQL = `
+with e as (
+	insert into entries (
+	user_id, headword, pinyin, english_definition, chinese_definition, freq,
+	stability, difficulty, lapses, state, last_review, due_at, reps_ct
+	) values ($1, $2, $3, $4, $5, $6, 0, 0, 0, 0, $9, $9, 0)
+	on conflict (user_id, headword) do update set
+	pinyin = excluded.pinyin,
+	english_definition = excluded.english_definition,
+	chinese_definition = excluded.chinese_definition,
+	freq = excluded.freq
+	where $7
+	returning headword, xmax = 0 as inserted
+),
+a as (
+	insert into card_aspects (user_id, headword, aspect, last_review, due_at)
+	select $1, e.headword, unnest($8::text[]), $9, $9 from e where e.inserted
+	on conflict do nothing
+)
+select inserted from e
+`
+
+// importCSV reads a CSV of importColumns from src and adds its rows as
+// cards, all in one transaction. Rows are parsed one at a time and sent
+// in batches, so the file is never held in memory. Rows that fail
+// validation are reported and skipped; a file that is not valid CSV, or
+// has the wrong header, fails with errBadCSV and imports nothing.
+// Duplicate headwords are updated when update is set and skipped
+// otherwise. New cards are due at now.
+func importCSV(ctx context.Context, db txBeginner, src io.Reader, update bool, aspects []string, now time.Time) (importReport, error) {
+	rep := importReport{Errors: []importRowError{}}
+	cr := csv.NewReader(src)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return rep, fmt.Errorf("%w: empty file", errBadCSV)
+	}
+	if err != nil {
+		return rep, fmt.Errorf("%w: %v", errBadCSV, err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	if !slices.EqualFunc(header, importColumns, func(got, want string) bool {
+		return strings.EqualFold(strings.TrimSpace(got), want)
+	}) {
+		return rep, fmt.Errorf("%w: header must be %s", errBadCSV, strings.Join(importColumns, ","))
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return rep, err
+	}
+	defer tx.Rollback(ctx)
+	batch := &pgx.Batch{}
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		err := tx.SendBatch(ctx, batch).Close()
+		batch = &pgx.Batch{}
+		return err
+	}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if pe := (*csv.ParseError)(nil); errors.As(err, &pe) && errors.Is(err, csv.ErrFieldCount) {
+			rep.reject(pe.StartLine, fmt.Sprintf("want %d fields, got %d", len(importColumns), len(record)))
+			continue
+		}
+		if err != nil {
+			return rep, fmt.Errorf("%w: %v", errBadCSV, err)
+		}
+		line, _ := cr.FieldPos(0)
+		c, msg := importRecord(record)
+		if msg != "" {
+			rep.reject(line, msg)
+			continue
+		}
+		batch.Queue(importCardSQL, userID(ctx), c.Headword, c.Pinyin, c.EnDef, c.ZhDef, c.Freq, update, aspects, now).QueryRow(func(row pgx.Row) error {
+			var inserted bool
+			switch err := row.Scan(&inserted); {
+			case errors.Is(err, pgx.ErrNoRows):
+				rep.Skipped++
+			case err != nil:
+				return err
+			case inserted:
+				rep.Inserted++
+			default:
+				rep.Updated++
+			}
+			return nil
+		})
+		if batch.Len() >= importBatchSize {
+			if err := flush(); err != nil {
+				return rep, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return rep, err
+	}
+	return rep, tx.Commit(ctx)
+}
+
+// importRecord validates one CSV row the way handleCreateCard validates
+// its form, returning the card or why the row was rejected.
+func importRecord(record []string) (Card, string) {
+	c := Card{
+		Headword: strings.TrimSpace(record[0]),
+		Pinyin:   strings.TrimSpace(record[1]),
+		EnDef:    strings.TrimSpace(record[2]),
+		ZhDef:    strings.TrimSpace(record[3]),
+	}
+	if c.Headword == "" {
+		return c, "headword is required"
+	}
+	if c.EnDef == "" && c.ZhDef == "" {
+		return c, "at least one definition is required"
+	}
+	if v := strings.TrimSpace(record[4]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return c, "freq must be a non-negative integer"
+		}
+		c.Freq = n
+	}
+	return c, ""
+}
+
+// exportedCard is one entries row in a deck dump, with every column a
+// restore needs. Nullable columns are pointers so a NULL survives the
+// round trip as a NULL.
+type exportedCard struct {
+	Headword   string           `json:"headword"`
+	Pinyin     string           `json:"pinyin"`
+	EnDef      string           `json:"english_definition"`
+	ZhDef      string           `json:"chinese_definition"`
+	Freq       *int             `json:"freq"`
+	ExampleZh  *string          `json:"example_sentence_zh"`
+	ExampleEn  *string          `json:"example_sentence_en"`
+	HSK        *int             `json:"hsk_level"`
+	Retention  *float64         `json:"desired_retention"`
+	NewOrder   *int             `json:"new_order"`
+	Stability  float64          `json:"stability"`
+	Difficulty float64          `json:"difficulty"`
+	Lapses     int              `json:"lapses"`
+	State      int              `json:"state"`
+	LastReview time.Time        `json:"last_review"`
+	Due        time.Time        `json:"due_at"`
+	Reps       int              `json:"reps_ct"`
+	Suspended  bool             `json:"suspended"`
+	Leech      bool             `json:"leech"`
+	Tags       []string         `json:"tags"`
+	Aspects    []exportedAspect `json:"aspects"`
+}
+
+// exportedAspect is one card_aspects row of an exportedCard.
+type exportedAspect struct {
+	Aspect     string    `json:"aspect"`
+	Stability  float64   `json:"stability"`
+	Difficulty float64   `json:"difficulty"`
+	Lapses     int       `json:"lapses"`
+	State      int       `json:"state"`
+	LastReview time.Time `json:"last_review"`
+	Due        time.Time `json:"due_at"`
+	Reps       int       `json:"reps_ct"`
+}
+
+// exportBatchSize is how many entries exportDeck reads per query.
+const exportBatchSize = 1000
+
+// exportDeck calls fn for every card in headword order. It reads in
+// keyset batches of exportBatchSize inside one repeatable-read
+// transaction, so memory stays flat however large the deck is and the
+// dump is a consistent snapshot.
+func exportDeck(ctx context.Context, db txBeginner, fn func(exportedCard) error) error {
+	const exportSQL = `
+select
+headword, pinyin, english_definition, chinese_definition, freq,
+example_sentence_zh, example_sentence_en, hsk_level, desired_retention, new_order,
+stability, difficulty, lapses, state, last_review, due_at, reps_ct,
+suspended, leech, tags,
+coalesce((
+	select json_agg(json_build_object(
+		'aspect', a.aspect, 'stability', a.stability, 'difficulty', a.difficulty,
+		'lapses', a.lapses, 'state', a.state, 'last_review', a.last_review,
+		'due_at', a.due_at, 'reps_ct', a.reps_ct
+	) order by a.aspect)
+	from card_aspects a
+	where a.user_id = e.user_id and a.headword = e.headword
+), '[]')
+from entries e
+where user_id = $1 and headword > $2 and deleted_at is null
+order by headword
+limit $3
+`
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `set transaction isolation level repeatable read, read only`); err != nil {
+		return err
+	}
+	after := ""
+	for {
+		rows, err := tx.Query(ctx, exportSQL, userID(ctx), after, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			var c exportedCard
+			err := rows.Scan(
+				&c.Headword, &c.Pinyin, &c.EnDef, &c.ZhDef, &c.Freq,
+				&c.ExampleZh, &c.ExampleEn, &c.HSK, &c.Retention, &c.NewOrder,
+				&c.Stability, &c.Difficulty, &c.Lapses, &c.State, &c.LastReview, &c.Due, &c.Reps,
+				&c.Suspended, &c.Leech, &c.Tags, &c.Aspects,
+			)
+			if err == nil {
+				err = fn(c)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+			after = c.Headword
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+// errBadDump marks a /import/json body that is not a deck dump.
+var errBadDump = errors.New("malformed deck dump")
+
+// restoreCardSQL upserts one exportedCard's entries row, content and
+// schedule alike, taking it out of the trash if it was there, and reports
+// whether it was new.
+const restoreCardSQL = `
+insert into entries (
+user_id, headword, pinyin, english_definition, chinese_definition, freq,
+example_sentence_zh, example_sentence_en, hsk_level, new_order,
+stability, difficulty, lapses, state, last_review, due_at, reps_ct,
+suspended, leech, tags, desired_retention
+) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, coalesce($20, '{}'::text[]), $21)
+on conflict (user_id, headword) do update set
+pinyin = excluded.pinyin,
+english_definition = excluded.english_definition,
+chinese_definition = excluded.chinese_definition,
+freq = excluded.freq,
+example_sentence_zh = excluded.example_sentence_zh,
+example_sentence_en = excluded.example_sentence_en,
+hsk_level = excluded.hsk_level,
+new_order = excluded.new_order,
+stability = excluded.stability,
+difficulty = excluded.difficulty,
+lapses = excluded.lapses,
+state = excluded.state,
+last_review = excluded.last_review,
+due_at = excluded.due_at,
+reps_ct = excluded.reps_ct,
+suspended = excluded.suspended,
+leech = excluded.leech,
+tags = excluded.tags,
+desired_retention = excluded.desired_retention,
+deleted_at = null,
+version = entries.version + 1
+returning xmax = 0
+`
+
+// restoreAspectSQL upserts one exportedAspect.
+const restoreAspectSQL = `
+insert into card_aspects (
+user_id, headword, aspect, stability, difficulty, lapses, state, last_review, due_at, reps_ct
+) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+on conflict (user_id, headword, aspect) do update set
+stability = excluded.stability,
+difficulty = excluded.difficulty,
+lapses = excluded.lapses,
+state = excluded.state,
+last_review = excluded.last_review,
+due_at = excluded.due_at,
+reps_ct = excluded.reps_ct,
+version = card_aspects.version + 1
+`
+
+// restoreDeck reads a JSON array of exportedCard from src, as written by
+// /export, and upserts each card by headword with its schedule exactly as
+// dumped, all in one transaction. The array is decoded one element at a
+// time and written in batches of importBatchSize. Scheduling fields may be
+// left out, so cards from another SRS can come in mid-schedule or as new;
+// see defaultSchedule. Cards that fail to decode or validate are reported
+// by array index (in Line) and skipped; a body that is not a JSON array
+// fails with errBadDump and restores nothing. now is the time missing
+// schedule fields default to.
+func restoreDeck(ctx context.Context, db txBeginner, src io.Reader, now time.Time) (importReport, error) {
+	rep := importReport{Errors: []importRowError{}}
+	dec := json.NewDecoder(src)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return rep, fmt.Errorf("%w: want a JSON array", errBadDump)
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return rep, err
+	}
+	defer tx.Rollback(ctx)
+	batch := &pgx.Batch{}
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		err := tx.SendBatch(ctx, batch).Close()
+		batch = &pgx.Batch{}
+		return err
+	}
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return rep, fmt.Errorf("%w: card %d: %v", errBadDump, i, err)
+		}
+		c, msg := parseDumpedCard(raw, now)
+		if msg != "" {
+			rep.reject(i, msg)
+			continue
+		}
+		batch.Queue(restoreCardSQL,
+			userID(ctx), c.Headword, c.Pinyin, c.EnDef, c.ZhDef, c.Freq,
+			c.ExampleZh, c.ExampleEn, c.HSK, c.NewOrder,
+			c.Stability, c.Difficulty, c.Lapses, c.State, c.LastReview, c.Due, c.Reps,
+			c.Suspended, c.Leech, c.Tags, c.Retention,
+		).QueryRow(func(row pgx.Row) error {
+			var inserted bool
+			if err := row.Scan(&inserted); err != nil {
+				return err
+			}
+			if inserted {
+				rep.Inserted++
+			} else {
+				rep.Updated++
+			}
+			return nil
+		})
+		for _, a := range c.Aspects {
+			batch.Queue(restoreAspectSQL,
+				userID(ctx), c.Headword, a.Aspect,
+				a.Stability, a.Difficulty, a.Lapses, a.State, a.LastReview, a.Due, a.Reps,
+			)
+		}
+		if batch.Len() >= importBatchSize {
+			if err := flush(); err != nil {
+				return rep, err
+			}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return rep, fmt.Errorf("%w: %v", errBadDump, err)
+	}
+	if err := flush(); err != nil {
+		return rep, err
+	}
+	return rep, tx.Commit(ctx)
+}
+
+// parseDumpedCard decodes one element of a dump into the card restoreDeck
+// writes, with its schedule defaulted at now, or returns why it is
+// rejected.
+func parseDumpedCard(raw json.RawMessage, now time.Time) (exportedCard, string) {
+	var c exportedCard
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, "invalid card: " + err.Error()
+	}
+	defaultSchedule(&c, now)
+	return c, validateExportedCard(c)
+}
+
+// defaultSchedule fills in the schedule times c left out the way a newly
+// created card has them: last reviewed and due at now. The other
+// scheduling fields already default to a New card's zeros.
+func defaultSchedule(c *exportedCard, now time.Time) {
+	if c.LastReview.IsZero() {
+		c.LastReview = now
+	}
+	if c.Due.IsZero() {
+		c.Due = now
+	}
+	for i := range c.Aspects {
+		a := &c.Aspects[i]
+		if a.LastReview.IsZero() {
+			a.LastReview = now
+		}
+		if a.Due.IsZero() {
+			a.Due = now
+		}
+	}
+}
+
+// validateSchedule returns why a dumped schedule is not one FSRS can
+// continue from, or "". A reviewed card needs the stability, difficulty
+// and reps repairCardStates would otherwise reset it for.
+func validateSchedule(state int, stability, difficulty float64, lapses, reps int) string {
+	switch {
+	case state < int(fsrs.New) || state > int(fsrs.Relearning):
+		return "state must be 0..3"
+	case stability < 0 || lapses < 0 || reps < 0:
+		return "stability, lapses and reps_ct must not be negative"
+	case lapses > reps:
+		return "lapses must not exceed reps_ct"
+	case state == int(fsrs.New):
+		return ""
+	case stability == 0:
+		return "a reviewed card needs a stability above 0"
+	case difficulty < 1 || difficulty > 10:
+		return "a reviewed card needs a difficulty of 1..10"
+	case reps == 0:
+		return "a reviewed card needs reps_ct of at least 1"
+	}
+	return ""
+}
+
+// validateExportedCard returns why c cannot be restored, or "".
+func validateExportedCard(c exportedCard) string {
+	if c.Headword == "" {
+		return "headword is required"
+	}
+	if msg := validateSchedule(c.State, c.Stability, c.Difficulty, c.Lapses, c.Reps); msg != "" {
+		return msg
+	}
+	if c.HSK != nil && (*c.HSK < 1 || *c.HSK > maxHSKLevel) {
+		return "hsk_level must be 1..9"
+	}
+	if c.Retention != nil && (*c.Retention <= 0 || *c.Retention >= 1) {
+		return "desired_retention must be between 0 and 1 exclusive"
+	}
+	for _, a := range c.Aspects {
+		if !extraAspects[a.Aspect] {
+			return fmt.Sprintf("unknown aspect %q", a.Aspect)
+		}
+		if msg := validateSchedule(a.State, a.Stability, a.Difficulty, a.Lapses, a.Reps); msg != "" {
+			return a.Aspect + " aspect: " + msg
+		}
+	}
+	return ""
+}
+
+// deleteCard moves a card to the trash by setting deleted_at. Every read
+// leaves trashed cards out, but the row keeps its schedule and aspect rows,
+// and review_log is untouched, so undeleteCard can bring it all back. It
+// reports whether there was such a card outside the trash.
+func deleteCard(ctx context.Context, db dbtx, headword string) (bool, error) {
+	tag, err := db.Exec(ctx, `update entries set deleted_at = now() where user_id = $1 and headword = $2 and deleted_at is null`, userID(ctx), headword)
+	return tag.RowsAffected() > 0, err
+}
+
+// undeleteCard takes a card back out of the trash, as it was when it was
+// deleted. It reports whether the card was in the trash.
+func undeleteCard(ctx context.Context, db dbtx, headword string) (bool, error) {
+	tag, err := db.Exec(ctx, `update entries set deleted_at = null where user_id = $1 and headword = $2 and deleted_at is not null`, userID(ctx), headword)
+	return tag.RowsAffected() > 0, err
+}
+
+// trashedCard is a card in the trash, as /trash lists it.
+type trashedCard struct {
+	Headword  string    `json:"headword"`
+	Pinyin    string    `json:"pinyin"`
+	EnDef     string    `json:"en_def"`
+	Reps      int       `json:"reps_ct"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// getTrash lists the trashed cards, most recently deleted first.
+func getTrash(ctx context.Context, db dbtx) ([]trashedCard, error) {
+	rows, err := db.Query(ctx, `
+select headword, pinyin, english_definition, reps_ct, deleted_at
+from entries
+where user_id = $1 and deleted_at is not null
+order by deleted_at desc, headword
+`, userID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[trashedCard])
+}
+
+// toggleSuspended flips a card's suspended flag and returns the new value,
+// or ok=false when there is no such card.
+func toggleSuspended(ctx context.Context, db dbtx, headword string) (suspended, ok bool, err error) {
+	err = db.QueryRow(ctx, `update entries set suspended = not suspended where user_id = $1 and headword = $2 and deleted_at is null returning suspended`, userID(ctx), headword).Scan(&suspended)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, false, nil
+	}
+	return suspended, err == nil, err
+}
+
+// markLeech flags a card as a leech and, with suspend, takes it out of the
+// queue. The flag is on the entry, so a leech in any aspect marks the
+// whole card.
+func markLeech(ctx context.Context, db dbtx, headword string, suspend bool) error {
+	_, err := db.Exec(ctx, `
+update entries set leech = true, suspended = suspended or $3
+where user_id = $1 and headword = $2
+`, userID(ctx), headword, suspend)
+	return err
+}
+
+// getLeeches lists the cards flagged as leeches, most lapses first.
+func getLeeches(ctx context.Context, db dbtx) ([]Card, error) {
+	rows, err := db.Query(ctx, cardQuery+` where user_id = $1 and leech and deleted_at is null order by lapses desc, headword`, userID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return scanCards(rows)
+}
+
+// getHardest returns the n cards with the most lapses, the most
+// difficult first among equals. Never-reviewed cards have neither and are
+// left out.
+func getHardest(ctx context.Context, db dbtx, n int) ([]Card, error) {
+	rows, err := db.Query(ctx, cardQuery+` where user_id = $1 and state <> 0 and deleted_at is null order by lapses desc, difficulty desc, headword limit $2`, userID(ctx), n)
+	if err != nil {
+		return nil, err
+	}
+	return scanCards(rows)
+}
+
+// setNewOrder assigns new_order 1..n to headwords in the given order and
+// returns the headwords that matched no card. With replace, every other
+// card's new_order is cleared so only this list is curated.
+func setNewOrder(ctx context.Context, pool *pgxpool.Pool, headwords []string, replace bool) ([]string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	if replace {
+		if _, err := tx.Exec(ctx, `update entries set new_order = null where user_id = $1 and new_order is not null`, userID(ctx)); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := tx.Query(ctx, `
+update entries e set new_order = o.ord
+from unnest($2::text[]) with ordinality as o(hw, ord)
+where e.user_id = $1 and e.headword = o.hw and e.deleted_at is null
+returning e.headword
+`, userID(ctx), headwords)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, h := range headwords {
+		if !slices.Contains(updated, h) {
+			missing = append(missing, h)
+		}
+	}
+	return missing, tx.Commit(ctx)
+}
+
+// dueCounts splits the cards due at some moment into those seen before
+// (Due) and those never reviewed (New).
+type dueCounts struct {
+	Due int `json:"due"`
+	New int `json:"new"`
+}
+
+// Total is every card due, seen or not.
+func (c dueCounts) Total() int {
+	return c.Due + c.New
+}
+
+// countDue counts cards due at now across recognition and the given
+// aspects.
+func countDue(ctx context.Context, db dbtx, aspects []string, now time.Time) (dueCounts, error) {
+	var c dueCounts
+	err := db.QueryRow(ctx, `
+select count(*) filter (where state > 0), count(*) filter (where state = 0) from (
+	select state from entries where user_id = $1 and $3 >= due_at and not suspended and deleted_at is null
+	union all
+	select a.state from card_aspects a join entries e using (user_id, headword)
+	where a.user_id = $1 and $3 >= a.due_at and a.aspect = any($2) and not e.suspended and e.deleted_at is null
+) due
+`, userID(ctx), aspects, now).Scan(&c.Due, &c.New)
+	return c, err
+}
+
+// nextDueAt returns the earliest due_at after now among the cards that
+// countDue considers and f lets through, or ok=false when nothing is
+// scheduled after now.
+func nextDueAt(ctx context.Context, db dbtx, aspects []string, now time.Time, f queueFilter) (_ time.Time, ok bool, err error) {
+	var at *time.Time
+	err = db.QueryRow(ctx, `
+select least(
+(select min(due_at) from entries where user_id = $1 and due_at > $3 and not suspended and deleted_at is null
+	and ($4::int = 0 or hsk_level = $4) and ($5::text = '' or $5 = any(tags))),
+(select min(a.due_at) from card_aspects a join entries e using (user_id, headword)
+	where a.user_id = $1 and a.due_at > $3 and a.aspect = any($2) and not e.suspended and e.deleted_at is null
+	and ($4::int = 0 or e.hsk_level = $4) and ($5::text = '' or $5 = any(e.tags)))
+)
+`, userID(ctx), aspects, now, f.HSK, f.Tag).Scan(&at)
+	if err != nil || at == nil {
+		return time.Time{}, false, err
+	}
+	return *at, true, nil
+}
+
+// countDueTotal is countDue summed over every user, for the cards_due
+// gauge.
+func countDueTotal(ctx context.Context, db dbtx, aspects []string, now time.Time) (int, error) {
+	var n int
+	err := db.QueryRow(ctx, `
+select
+(select count(*) from entries where $2 >= due_at and not suspended and deleted_at is null)
++ (select count(*) from card_aspects a join entries e using (user_id, headword)
+	where $2 >= a.due_at and a.aspect = any($1) and not e.suspended and e.deleted_at is null)
+`, aspects, now).Scan(&n)
+	return n, err
+}
+
+// dueCountCache memoizes each user's due counts for ttl. Writers that
+// change the queue call invalidate before responding, so a read after a
+// grade is always fresh; the generation counter stops a load that raced
+// with an invalidate from storing its stale result. invalidate drops every
+// user's count: it is cheap to reload and keeps writers from having to
+// know whose queue they touched.
+type dueCountCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	gen     uint64
+	entries map[string]dueCountEntry
+}
+
+type dueCountEntry struct {
+	counts  dueCounts
+	expires time.Time
+}
+
+// get returns the user's cached counts at now, or calls load for them.
+func (c *dueCountCache) get(ctx context.Context, now time.Time, load func(context.Context) (dueCounts, error)) (dueCounts, error) {
+	user := userID(ctx)
+	c.mu.Lock()
+	if e, ok := c.entries[user]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.counts, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	n, err := load(ctx)
+	if err != nil {
+		return dueCounts{}, err
+	}
+	c.mu.Lock()
+	if c.gen == gen && c.ttl > 0 {
+		if c.entries == nil {
+			c.entries = map[string]dueCountEntry{}
+		}
+		c.entries[user] = dueCountEntry{counts: n, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return n, nil
+}
+
+func (c *dueCountCache) invalidate() {
+	c.mu.Lock()
+	c.gen++
+	clear(c.entries)
+	c.mu.Unlock()
+}
+
+// nextDueCache memoizes application.nextDue per user, order and filter.
+// Besides writers' invalidate calls, the due set changes by itself when a
+// card falls due, so an entry expires then (brought forward by the
+// learn-ahead window, which shows a card that much early) or after ttl,
+// whichever is sooner. ttl bounds how long a write made by another
+// instance can go unseen. The generation counter works as in
+// dueCountCache.
+type nextDueCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	gen     uint64
+	entries map[nextDueKey]nextDueEntry
+}
+
+type nextDueKey struct {
+	user  string
+	order reviewOrder
+	f     queueFilter
+}
+
+type nextDueEntry struct {
+	card    *Card // nil: nothing due
+	expires time.Time
+}
+
+// get returns the cached card for key at now, or calls load for the card
+// and the time it stops being valid. Callers get their own copy.
+func (c *nextDueCache) get(ctx context.Context, key nextDueKey, now time.Time, load func(context.Context) (*Card, time.Time, error)) (*Card, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		return copyCard(e.card), nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	card, expires, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen && now.Before(expires) {
+		if c.entries == nil {
+			c.entries = map[nextDueKey]nextDueEntry{}
+		}
+		c.entries[key] = nextDueEntry{card: copyCard(card), expires: expires}
+	}
+	c.mu.Unlock()
+	return card, nil
+}
+
+func (c *nextDueCache) invalidate() {
+	c.mu.Lock()
+	c.gen++
+	clear(c.entries)
+	c.mu.Unlock()
+}
+
+func copyCard(c *Card) *Card {
+	if c == nil {
+		return nil
+	}
+	cp := *c
+	return &cp
+}
+
+// queueChanged drops the cached due counts and next-due cards. Every
+// handler that changes what is due, or where a card stands in the queue,
+// calls it before responding.
+func (app *application) queueChanged() {
+	app.dueCount.invalidate()
+	app.nextDueCache.invalidate()
+}
+
+// dueCountsNow returns the user's due counts, through dueCountCache.
+func (app *application) dueCountsNow(ctx context.Context) (dueCounts, error) {
+	now := app.clock.Now()
+	return app.dueCount.get(ctx, now, func(ctx context.Context) (dueCounts, error) {
+		counts, err := app.cards.CountDue(ctx, now)
+		if err != nil {
+			return counts, err
+		}
+		left, err := app.newCardsLeft(ctx, app.sched.Load(), now)
+		if left >= 0 {
+			counts.New = min(counts.New, left)
+		}
+		return counts, err
+	})
+}
+
+func (app *application) dueCountNow(ctx context.Context) (int, error) {
+	c, err := app.dueCountsNow(ctx)
+	return c.Total(), err
+}
+
+// paramImpact is one card's stored due date against the due date its
+// current stability implies under a parameter set.
+type paramImpact struct {
+	Headword   string    `json:"headword"`
+	Aspect     string    `json:"aspect"`
+	Stability  float64   `json:"stability"`
+	StoredDue  time.Time `json:"stored_due_at"`
+	WouldBeDue time.Time `json:"would_be_due_at"`
+	DeltaDays  float64   `json:"delta_days"`
+}
+
+// getParamImpact recomputes the due date of every Review/Relearning card
+// and aspect under s without writing anything, as rescheduleCards would
+// move the same cards, and returns the limit cards whose stored due_at is
+// furthest off, plus how many cards were examined. Rows are streamed and
+// only the furthest limit kept, so memory is bounded by limit rather than
+// by the deck.
+func getParamImpact(ctx context.Context, pool *pgxpool.Pool, s *scheduling, limit int) ([]paramImpact, int, error) {
+	rows, err := pool.Query(ctx, `
+select headword, 'recognition', stability, desired_retention, reps_ct, last_review, due_at
+from entries
+where user_id = $1 and state in (2, 3) and stability > 0 and deleted_at is null
+union all
+select a.headword, a.aspect, a.stability, e.desired_retention, a.reps_ct, a.last_review, a.due_at
+from card_aspects a
+join entries e on e.user_id = a.user_id and e.headword = a.headword and e.deleted_at is null
+where a.user_id = $1 and a.state in (2, 3) and a.stability > 0
+`, userID(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	// top is kept sorted furthest first.
+	top := make([]paramImpact, 0, limit)
+	further := func(a, b paramImpact) int {
+		return cmp.Compare(math.Abs(b.DeltaDays), math.Abs(a.DeltaDays))
+	}
+	examined := 0
+	for rows.Next() {
+		var (
+			im paramImpact
+			c  Card
+		)
+		if err := rows.Scan(&im.Headword, &im.Aspect, &im.Stability, &c.DesiredRetention, &c.Reps, &c.LastReview, &im.StoredDue); err != nil {
+			return nil, 0, err
+		}
+		examined++
+		c.Stability = im.Stability
+		s.dueFromStability(&c)
+		im.WouldBeDue = c.Due
+		im.DeltaDays = im.WouldBeDue.Sub(im.StoredDue).Hours() / 24
+		if i, _ := slices.BinarySearchFunc(top, im, further); i < limit {
+			top = slices.Insert(top, i, im)
+			top = top[:min(len(top), limit)]
+		}
+	}
+	return top, examined, rows.Err()
+}
+
+// rescheduleBatch is how many cards rescheduleCards rewrites per
+// transaction.
+const rescheduleBatch = 500
+
+// rescheduleCards moves the due_at of every Review/Relearning card and
+// aspect not in the trash to where dueFromStability puts it under s, so a
+// change of weights or desired retention applies to the existing queue
+// and not just to cards graded from now on. Nothing else about the
+// schedule changes. It works through each table in batches of
+// rescheduleBatch, one transaction per batch, and returns how many cards
+// were examined and how many actually moved.
+func rescheduleCards(ctx context.Context, pool *pgxpool.Pool, s *scheduling) (examined, moved int, err error) {
+	// Each table is read as c joined to its entry e, which holds the
+	// desired retention and whether the card is in the trash. aspect is
+	// the second half of the table's key (entries only have the
+	// recognition aspect), as the select and the update spell it.
+	tables := []struct{ table, aspect, updateAspect string }{
+		{"entries", "''::text", "''::text"},
+		{"card_aspects", "c.aspect", "card_aspects.aspect"},
+	}
+	for _, t := range tables {
+		selectSQL := `
+select c.headword, ` + t.aspect + `, c.stability, e.desired_retention, c.reps_ct, c.last_review, c.due_at
+from ` + t.table + ` c
+join entries e on e.user_id = c.user_id and e.headword = c.headword and e.deleted_at is null
+where c.user_id = $1 and c.state in (2, 3) and c.stability > 0 and (c.headword, ` + t.aspect + `) > ($2, $3)
+order by c.headword, ` + t.aspect + `
+limit $4
+for update of c`
+		updateSQL := `
+update ` + t.table + ` set due_at = u.due, version = ` + t.table + `.version + 1
+from unnest($2::text[], $3::text[], $4::timestamptz[]) as u(headword, aspect, due)
+where ` + t.table + `.user_id = $1 and ` + t.table + `.headword = u.headword and ` + t.updateAspect + ` = u.aspect`
+		var afterHeadword, afterAspect string
+		for {
+			n, m, err := rescheduleBatchTx(ctx, pool, s, selectSQL, updateSQL, &afterHeadword, &afterAspect)
+			if err != nil {
+				return examined, moved, err
+			}
+			examined += n
+			moved += m
+			if n < rescheduleBatch {
+				break
+			}
+		}
+	}
+	return examined, moved, nil
+}
+
+// rescheduleBatchTx reschedules the next batch after the key
+// (afterHeadword, afterAspect) in one transaction and advances the key.
+func rescheduleBatchTx(ctx context.Context, pool *pgxpool.Pool, s *scheduling, selectSQL, updateSQL string, afterHeadword, afterAspect *string) (examined, moved int, err error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, selectSQL, userID(ctx), *afterHeadword, *afterAspect, rescheduleBatch)
+	if err != nil {
+		return 0, 0, err
+	}
+	var headwords, aspects []string
+	var dues []time.Time
+	for rows.Next() {
+		var (
+			c      Card
+			oldDue time.Time
+		)
+		if err := rows.Scan(&c.Headword, &c.Aspect, &c.Stability, &c.DesiredRetention, &c.Reps, &c.LastReview, &oldDue); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		examined++
+		*afterHeadword, *afterAspect = c.Headword, c.Aspect
+		s.dueFromStability(&c)
+		if c.Due.Equal(oldDue) {
+			continue
+		}
+		headwords = append(headwords, c.Headword)
+		aspects = append(aspects, c.Aspect)
+		dues = append(dues, c.Due)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(dues) > 0 {
+		if _, err := tx.Exec(ctx, updateSQL, userID(ctx), headwords, aspects, dues); err != nil {
+			return 0, 0, err
+		}
+	}
+	return examined, len(dues), tx.Commit(ctx)
+}
+
+// historyReview is one review_log row as the optimizer replays it.
+type historyReview struct {
+	rating fsrs.Rating
+	at     time.Time
+	// fresh is set when the card was New before this review: its first
+	// review, or the first after a reset. The replay starts over there.
+	fresh bool
+}
+
+// loggedCard is the review log of one aspect of a card, oldest first.
+type loggedCard struct {
+	headword, aspect string
+	reviews          []historyReview
+}
+
+// getLoggedReviews loads the user's review log grouped per card (headword
+// and aspect), each oldest first: every card's, or only headword's aspects
+// when headword isn't "". Recognition reviews are logged with aspect ""
+// or "recognition" and come back together as "recognition".
+func getLoggedReviews(ctx context.Context, db dbtx, headword string) ([]loggedCard, error) {
+	rows, err := db.Query(ctx, `
+select headword, coalesce(nullif(aspect, ''), 'recognition') as aspect, rating, reviewed_at, old_state
+from review_log
+where user_id = $1 and ($2 = '' or headword = $2)
+order by headword, 2, reviewed_at, id
+`, userID(ctx), headword)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		logged           []loggedCard
+		aspect           string
+		rating, oldState int
+		at               time.Time
+	)
+	for rows.Next() {
+		if err := rows.Scan(&headword, &aspect, &rating, &at, &oldState); err != nil {
+			return nil, err
+		}
+		if len(logged) == 0 || headword != logged[len(logged)-1].headword || aspect != logged[len(logged)-1].aspect {
+			logged = append(logged, loggedCard{headword: headword, aspect: aspect})
+		}
+		lc := &logged[len(logged)-1]
+		lc.reviews = append(lc.reviews, historyReview{rating: fsrs.Rating(rating), at: at, fresh: oldState == int(fsrs.New)})
+	}
+	return logged, rows.Err()
+}
+
+// getReviewHistory loads the user's review log as one sequence per card
+// (headword and aspect), each oldest first.
+func getReviewHistory(ctx context.Context, pool *pgxpool.Pool) ([][]historyReview, error) {
+	logged, err := getLoggedReviews(ctx, pool, "")
+	if err != nil {
+		return nil, err
+	}
+	history := make([][]historyReview, len(logged))
+	for i, lc := range logged {
+		history[i] = lc.reviews
+	}
+	return history, nil
+}
+
+// historyLoss replays every sequence in history under p and returns the
+// mean log loss of p's recall predictions and how many reviews were
+// predicted. Only reviews a day or more after the previous one count:
+// same-day learning steps test short-term memory, not the forgetting
+// curve the weights describe.
+func historyLoss(p fsrs.Parameters, history [][]historyReview) (float64, int) {
+	f := fsrs.NewFSRS(p)
+	var loss float64
+	var n int
+	for _, seq := range history {
+		c := fsrs.NewCard()
+		for _, rv := range seq {
+			if rv.fresh {
+				c = fsrs.NewCard()
+			}
+			if c.State != fsrs.New && rv.at.Sub(c.LastReview) >= 24*time.Hour {
+				r := min(max(f.GetRetrievability(c, rv.at), 1e-4), 1-1e-4)
+				if rv.rating == fsrs.Again {
+					loss -= math.Log(1 - r)
+				} else {
+					loss -= math.Log(r)
+				}
+				n++
+			}
+			c = f.Next(c, rv.at, rv.rating).Card
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return loss / float64(n), n
+}
+
+// weightBounds keeps each FSRS weight in the range the reference
+// optimizer clips it to.
+var weightBounds = [len(fsrs.Weights{})][2]float64{
+	{0.001, 100}, {0.001, 100}, {0.001, 100}, {0.001, 100},
+	{1, 10}, {0.001, 4}, {0.001, 4}, {0.001, 0.75},
+	{0, 4.5}, {0, 0.8}, {0.001, 3.5},
+	{0.001, 5}, {0.001, 0.25}, {0.001, 0.9}, {0, 4},
+	{0, 1}, {1, 6},
+	{0, 2}, {0, 2},
+}
+
+const (
+	// optimizeSteps is how many gradient steps optimizeWeights takes.
+	optimizeSteps = 100
+	// minOptimizeReviews is the fewest predicted reviews worth fitting
+	// weights to; with less, the defaults are a better guess.
+	minOptimizeReviews = 200
+)
+
+var errNotEnoughHistory = fmt.Errorf("need at least %d reviews a day or more apart to optimize", minOptimizeReviews)
+
+// optimizeResult is what optimizeWeights found.
+type optimizeResult struct {
+	Weights    fsrs.Weights `json:"weights"`
+	Reviews    int          `json:"reviews"`
+	LossBefore float64      `json:"loss_before"`
+	LossAfter  float64      `json:"loss_after"`
+	// Saved is set once the weights are stored in user_params.
+	Saved bool `json:"saved"`
+}
+
+// optimizeWeights fits p's weights to history by minimizing historyLoss
+// with Adam, taking the gradient by finite differences since go-fsrs has
+// no training routine of its own. Each weight's step is scaled to its
+// starting size and kept within weightBounds. progress, if set, is called
+// after every step. The best weights seen are returned, so the result is
+// never worse than p on this history.
+func optimizeWeights(ctx context.Context, p fsrs.Parameters, history [][]historyReview, progress func(step int)) (optimizeResult, error) {
+	loss, n := historyLoss(p, history)
+	if n < minOptimizeReviews {
+		return optimizeResult{}, errNotEnoughHistory
+	}
+	res := optimizeResult{Weights: p.W, Reviews: n, LossBefore: loss, LossAfter: loss}
+	const (
+		lr    = 0.02
+		beta1 = 0.9
+		beta2 = 0.999
+		eps   = 1e-8
+	)
+	var scale, m, v fsrs.Weights
+	for i, w := range p.W {
+		scale[i] = max(math.Abs(w), 0.1)
+	}
+	w := p.W
+	for step := 1; step <= optimizeSteps; step++ {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		var grad fsrs.Weights
+		var wg sync.WaitGroup
+		for i := range w {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				q := p
+				q.W = w
+				h := 1e-4 * scale[i]
+				q.W[i] += h
+				l, _ := historyLoss(q, history)
+				grad[i] = (l - loss) / h
+			}()
+		}
+		wg.Wait()
+		for i := range w {
+			g := grad[i] * scale[i]
+			m[i] = beta1*m[i] + (1-beta1)*g
+			v[i] = beta2*v[i] + (1-beta2)*g*g
+			mHat := m[i] / (1 - math.Pow(beta1, float64(step)))
+			vHat := v[i] / (1 - math.Pow(beta2, float64(step)))
+			w[i] -= lr * scale[i] * mHat / (math.Sqrt(vHat) + eps)
+			w[i] = min(max(w[i], weightBounds[i][0]), weightBounds[i][1])
+		}
+		q := p
+		q.W = w
+		loss, _ = historyLoss(q, history)
+		if loss < res.LossAfter {
+			res.Weights, res.LossAfter = w, loss
+		}
+		if progress != nil {
+			progress(step)
+		}
+	}
+	return res, nil
+}
+
+// updateCardInDB writes c's schedule if the row is still at c.Version,
+// bumping the version, and fails with errStaleCard if it is not (or the
+// card is gone).
+func updateCardInDB(ctx context.Context, db dbtx, c Card) error {
+	const updateSQL = `
+update entries set
+stability = $1,
+difficulty = $2,
+lapses = $3,
+state = $4,
+last_review = $5,
+due_at = $6,
+reps_ct = $7,
+version = version + 1
+where user_id = $8 and headword = $9 and version = $10
+`
+	tag, err := db.Exec(ctx, updateSQL,
+		c.Stability,
+		c.Difficulty,
+		c.Lapses,
+		c.State,
+		c.LastReview,
+		c.Due,
+		c.Reps,
+		userID(ctx),
+		c.Headword,
+		c.Version,
+	)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errStaleCard
+	}
+	return err
+}
+
+// dbStatus picks the response status for a failed query: 504 when it ran
+// out of time (see withQueryTimeout), 500 for anything else.
+func dbStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// cardsETag is a validator for a JSON response built from cards: a hash
+// of their stored fields, so any write to one of them (a grade, an edit, a
+// tag) or a different card changes it. It is weak because the derived
+// elapsed_days and overdue_days drift with the clock between writes.
+func cardsETag(cards ...Card) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, c := range cards {
+		enc.Encode(c)
+	}
+	return `W/"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// notModified sets etag on the response and, if the request's
+// If-None-Match already names it, writes 304 and reports true. Responses
+// are per user, so they are marked private and must be revalidated.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// setLastModified sets Last-Modified to the latest review among cards, if
+// any has one. It is informational: edits do not move it, so conditional
+// requests go by ETag only.
+func setLastModified(w http.ResponseWriter, cards ...Card) {
+	var last time.Time
+	for _, c := range cards {
+		if c.LastReview.After(last) {
+			last = c.LastReview
+		}
+	}
+	if !last.IsZero() {
+		w.Header().Set("Last-Modified", last.UTC().Format(http.TimeFormat))
+	}
+}
+
+// stateRepairs are the corrections applied by repairCardStates, in order.
+// Each one only matches rows its own SET clause makes consistent, so
+// running the whole list again is a no-op.
+var stateRepairs = []struct {
+	Name string
+	SQL  string
+}{
+	{
+		// Anything outside New..Relearning cannot be scheduled at all.
+		Name: "invalid_state",
+		SQL: `update entries set state = 0, stability = 0, difficulty = 0, reps_ct = 0, lapses = 0, version = version + 1
+where state not between 0 and 3 returning headword`,
+	},
+	{
+		// A reviewed card without stability has nothing for FSRS to build
+		// on; start it over as new.
+		Name: "reviewed_without_stability",
+		SQL: `update entries set state = 0, stability = 0, difficulty = 0, reps_ct = 0, lapses = 0, version = version + 1
+where state > 0 and stability <= 0 returning headword`,
+	},
+	{
+		// New cards carry no history.
+		Name: "new_with_history",
+		SQL: `update entries set reps_ct = 0, lapses = 0, version = version + 1
+where state = 0 and (reps_ct <> 0 or lapses <> 0) returning headword`,
+	},
+	{
+		// Review/Relearning with no reps was never really graduated:
+		// demote to Learning with the one review it must have had.
+		Name: "reviewed_without_reps",
+		SQL: `update entries set state = case when state > 1 then 1 else state end, reps_ct = 1, version = version + 1
+where state > 0 and reps_ct = 0 returning headword`,
+	},
+	{
+		// Every lapse is a review, so lapses can never exceed reps.
+		Name: "lapses_exceed_reps",
+		SQL: `update entries set lapses = reps_ct, version = version + 1
+where lapses > reps_ct returning headword`,
+	},
+}
+
+// repairReport maps a repair rule name to the headwords it changed.
+type repairReport map[string][]string
+
+// repairCardStates fixes impossible state/reps/lapses combinations in a
+// single transaction, across every user's deck (the rules only touch rows that
+// are broken). With dryRun the changes are reported but rolled back.
+func repairCardStates(ctx context.Context, pool *pgxpool.Pool, dryRun bool) (repairReport, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	report := repairReport{}
+	for _, rule := range stateRepairs {
+		rows, err := tx.Query(ctx, rule.SQL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		headwords, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		if len(headwords) > 0 {
+			report[rule.Name] = headwords
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit(ctx)
+}
+
+// updateAspectInDB is updateCardInDB for an extra aspect.
+func updateAspectInDB(ctx context.Context, db dbtx, c Card) error {
+	const updateSQL = `
+update card_aspects set
+stability = $1,
+difficulty = $2,
+lapses = $3,
+state = $4,
+last_review = $5,
+due_at = $6,
+reps_ct = $7,
+version = version + 1
+where user_id = $8 and headword = $9 and aspect = $10 and version = $11
+`
+	tag, err := db.Exec(ctx, updateSQL,
+		c.Stability,
+		c.Difficulty,
+		c.Lapses,
+		c.State,
+		c.LastReview,
+		c.Due,
+		c.Reps,
+		userID(ctx),
+		c.Headword,
+		c.Aspect,
+		c.Version,
+	)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errStaleCard
+	}
+	return err
+}
+
+// getSetting decodes the JSON value stored under key into v. It reports
+// false when the key is unset.
+func getSetting(ctx context.Context, pool *pgxpool.Pool, key string, v any) (bool, error) {
+	var raw []byte
+	err := pool.QueryRow(ctx, `select value from settings where user_id = $1 and key = $2`, userID(ctx), key).Scan(&raw)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+func putSetting(ctx context.Context, pool *pgxpool.Pool, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = pool.Exec(ctx, `
+insert into settings (user_id, key, value) values ($1, $2, $3)
+on conflict (user_id, key) do update set value = excluded.value, updated_at = now()
+`, userID(ctx), key, raw)
+	return err
+}
+
+// getUserParams returns the user's own FSRS weights and desired
+// retention from user_params, or ok=false when they have none.
+func getUserParams(ctx context.Context, db dbtx) (w fsrs.Weights, retention float64, ok bool, err error) {
+	var weights []float64
+	err = db.QueryRow(ctx, `select weights, desired_retention from user_params where user_id = $1`, userID(ctx)).Scan(&weights, &retention)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return w, 0, false, nil
+		}
+		return w, 0, false, err
+	}
+	if len(weights) != len(w) {
+		return w, 0, false, fmt.Errorf("user_params: %d weights, want %d", len(weights), len(w))
+	}
+	copy(w[:], weights)
+	return w, retention, true, nil
+}
+
+func putUserParams(ctx context.Context, pool *pgxpool.Pool, w fsrs.Weights, retention float64) error {
+	_, err := pool.Exec(ctx, `
+insert into user_params (user_id, weights, desired_retention) values ($1, $2, $3)
+on conflict (user_id) do update set weights = excluded.weights, desired_retention = excluded.desired_retention, updated_at = now()
+`, userID(ctx), w[:], retention)
+	return err
+}
+
+// vacation is the settings value stored under vacationKey while vacation
+// mode is on. Until is informational; the shift applied on disable always
+// uses the actual time away.
+type vacation struct {
+	Start time.Time  `json:"start"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+const vacationKey = "vacation"
+
+// endVacation pushes every schedule not touched since v.Start forward by
+// the time spent away, up to now, then clears the setting. Only due_at moves:
+// last_review stays put so FSRS still sees the real elapsed time (and the
+// real forgetting) at the next review; what is preserved is the queue's
+// shape, so nothing piles up as overdue. Cards reviewed during the
+// vacation already have a fresh due_at and are left alone, as are New
+// cards, which have no schedule to preserve, and cards in the trash.
+func endVacation(ctx context.Context, pool *pgxpool.Pool, v vacation, now time.Time) (int64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var shifted int64
+	// card_aspects has no deleted_at of its own; its entry's counts.
+	for _, q := range []string{`
+update entries set due_at = due_at + ($3::timestamptz - $1), version = version + 1
+where user_id = $2 and last_review < $1 and state in (1, 2, 3) and deleted_at is null
+`, `
+update card_aspects a set due_at = a.due_at + ($3::timestamptz - $1), version = a.version + 1
+from entries e
+where a.user_id = $2 and a.last_review < $1 and a.state in (1, 2, 3)
+and e.user_id = a.user_id and e.headword = a.headword and e.deleted_at is null
+`} {
+		tag, err := tx.Exec(ctx, q, v.Start, userID(ctx), now)
+		if err != nil {
+			return 0, err
+		}
+		shifted += tag.RowsAffected()
+	}
+	if _, err := tx.Exec(ctx, `delete from settings where user_id = $1 and key = $2`, userID(ctx), vacationKey); err != nil {
+		return 0, err
+	}
+	return shifted, tx.Commit(ctx)
+}
+
+// defaultUser owns every card when no identity source is configured; the
+// user_id migration assigns it to existing rows.
+const defaultUser = "default"
+
+type userIDKey struct{}
+
+func withUserID(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, user)
+}
+
+// userID returns the user a request acts for, which every query on cards,
+// settings and logs is scoped to. Work outside a request (startup jobs)
+// runs as defaultUser.
+func userID(ctx context.Context) string {
+	if u, ok := ctx.Value(userIDKey{}).(string); ok {
+		return u
+	}
+	return defaultUser
+}
+
+// identifier resolves the user a request acts for. ok=false rejects the
+// request as unauthenticated. It is the seam for plugging in real auth.
+type identifier func(r *http.Request) (user string, ok bool)
+
+// singleUser puts everyone on the default deck, as before user scoping.
+func singleUser(*http.Request) (string, bool) {
+	return defaultUser, true
+}
+
+// headerIdentity trusts header to name the user, for deploys behind a
+// proxy that authenticates and sets it. Requests without it are rejected.
+func headerIdentity(header string) identifier {
+	return func(r *http.Request) (string, bool) {
+		u := strings.TrimSpace(r.Header.Get(header))
+		return u, u != ""
+	}
+}
+
+const sessionCookie = "anamnesis_session"
+
+// sessionID returns the browser's review session id, issuing a random one
+// in a cookie on first use.
+func sessionID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+const (
+	tallyCookie = "anamnesis_tally"
+	// tallyIdle is how long a review session may pause before the next
+	// grade starts a new one.
+	tallyIdle = time.Hour
+)
+
+// sessionTally counts a browser's grades in the current review session,
+// kept in a signed cookie so the server holds no session state. Undo is
+// the rating of the latest grade, so undoing it can take it back once.
+type sessionTally struct {
+	Ratings [4]int `json:"r"`
+	Undo    int    `json:"u,omitempty"`
+	Last    int64  `json:"t"`
+}
+
+// Total is the number of cards graded in the session.
+func (t sessionTally) Total() int {
+	return t.Ratings[0] + t.Ratings[1] + t.Ratings[2] + t.Ratings[3]
+}
+
+// Count is how many grades were rating, for use as {{.Count 3}}.
+func (t sessionTally) Count(rating int) int {
+	if rating < 1 || rating > len(t.Ratings) {
+		return 0
+	}
+	return t.Ratings[rating-1]
+}
+
+// summaryPage is the data for summary.html, shown when nothing is due:
+// the session just finished and when the next card comes due.
+type summaryPage struct {
+	sessionTally
+	Now     time.Time
+	NextDue time.Time // zero when nothing is scheduled
+}
+
+// NextIn is how long until the next card is due, as "3h 20m".
+func (p summaryPage) NextIn() string {
+	return formatCountdown(p.NextDue.Sub(p.Now))
+}
+
+// NextAt is when the next card is due in the app's time zone, relative to
+// today: "today at 15:40", "tomorrow at 9:00" or "on Mon 2 Jan at 9:00".
+func (p summaryPage) NextAt() string {
+	next, now := p.NextDue.In(p.Now.Location()), p.Now
+	clock := next.Format("15:04")
+	switch days := dayNumber(next) - dayNumber(now); days {
+	case 0:
+		return "today at " + clock
+	case 1:
+		return "tomorrow at " + clock
+	default:
+		return "on " + next.Format("Mon 2 Jan") + " at " + clock
+	}
+}
+
+// dayNumber counts calendar days in t's location, so two times can be
+// compared by date.
+func dayNumber(t time.Time) int {
+	y, m, d := t.Date()
+	return int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+
+// formatCountdown renders d to the minute with its two largest units:
+// "45m", "3h 20m", "2d 5h".
+func formatCountdown(d time.Duration) string {
+	m := int(d.Round(time.Minute) / time.Minute)
+	switch {
+	case m < 1:
+		return "less than a minute"
+	case m < 60:
+		return fmt.Sprintf("%dm", m)
+	case m < 24*60:
+		return fmt.Sprintf("%dh %dm", m/60, m%60)
+	default:
+		return fmt.Sprintf("%dd %dh", m/(24*60), m%(24*60)/60)
+	}
+}
+
+// tallyMAC signs a tally; the prefix keeps a tally from ever verifying as
+// a review token, which shares the key.
+func (app *application) tallyMAC(payload []byte) []byte {
+	return app.tokenMAC(append([]byte("tally:"), payload...))
+}
+
+// readTally returns the request's session tally, or an empty one when the
+// cookie is missing, forged, or older than tallyIdle.
+func (app *application) readTally(r *http.Request, now time.Time) sessionTally {
+	var t sessionTally
+	c, err := r.Cookie(tallyCookie)
+	if err != nil {
+		return t
+	}
+	enc := base64.RawURLEncoding
+	p, m, _ := strings.Cut(c.Value, ".")
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return t
+	}
+	mac, err := enc.DecodeString(m)
+	if err != nil || !hmac.Equal(mac, app.tallyMAC(payload)) {
+		return t
+	}
+	if json.Unmarshal(payload, &t) != nil || now.Sub(time.Unix(t.Last, 0)) > tallyIdle {
+		return sessionTally{}
+	}
+	return t
+}
+
+// writeTally stores t in the tally cookie; a zero tally clears it.
+func (app *application) writeTally(w http.ResponseWriter, r *http.Request, t sessionTally) {
+	c := &http.Cookie{
+		Name:     tallyCookie,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if t.Total() == 0 {
+		c.MaxAge = -1
+	} else {
+		payload, _ := json.Marshal(t)
+		enc := base64.RawURLEncoding
+		c.Value = enc.EncodeToString(payload) + "." + enc.EncodeToString(app.tallyMAC(payload))
+	}
+	http.SetCookie(w, c)
+}
+
+// logReveal records that the session was shown c's answer at at.
+func logReveal(ctx context.Context, pool *pgxpool.Pool, session string, c Card, at time.Time) error {
+	_, err := pool.Exec(ctx, `insert into reveals (user_id, headword, aspect, session, revealed_at) values ($1, $2, $3, $4, $5)`, userID(ctx), c.Headword, c.Aspect, session, at)
+	return err
+}
+
+// markRevealGraded closes the session's latest open reveal of the card as
+// graded at at.
+func markRevealGraded(ctx context.Context, pool *pgxpool.Pool, session string, c Card, at time.Time) error {
+	_, err := pool.Exec(ctx, `
+update reveals set graded_at = $5
+where id = (
+	select id from reveals
+	where user_id = $1 and session = $2 and headword = $3 and aspect = $4 and graded_at is null
+	order by revealed_at desc limit 1
+)`, userID(ctx), session, c.Headword, c.Aspect, at)
+	return err
+}
+
+// historyEntry is one past review of a card: when, how it was rated, the
+// interval that grade set, from the review to the due date it gave, and
+// the stability it left the card with.
+type historyEntry struct {
+	ReviewedAt   time.Time `json:"reviewed_at"`
+	Rating       int       `json:"rating"`
+	IntervalDays float64   `json:"interval_days"`
+	Stability    float64   `json:"stability"`
+}
+
+// Interval formats the interval for templates, like the grade buttons.
+func (h historyEntry) Interval() string {
+	return formatInterval(time.Duration(h.IntervalDays * float64(24*time.Hour)))
+}
+
+// getCardHistory returns the logged reviews of one aspect of a card,
+// oldest first. Undone grades are gone from the log and so from here.
+func getCardHistory(ctx context.Context, pool *pgxpool.Pool, headword, aspect string) ([]historyEntry, error) {
+	if aspect == aspectRecognition {
+		aspect = ""
+	}
+	rows, err := pool.Query(ctx, `
+select reviewed_at, rating, extract(epoch from new_due - reviewed_at) / 86400, new_stability
+from review_log
+where user_id = $1 and headword = $2 and (aspect = $3 or ($3 = '' and aspect = 'recognition'))
+order by reviewed_at, id
+`, userID(ctx), headword, aspect)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []historyEntry{}
+	for rows.Next() {
+		var h historyEntry
+		if err := rows.Scan(&h.ReviewedAt, &h.Rating, &h.IntervalDays, &h.Stability); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+type revealStats struct {
+	Reveals   int     `json:"reveals"`
+	Graded    int     `json:"graded"`
+	Abandoned int     `json:"abandoned"`
+	DropOff   float64 `json:"drop_off_rate"`
+}
+
+// getRevealStats counts reveals in the days days before now. Reveals
+// younger than an hour are still in flight and left out of both sides.
+func getRevealStats(ctx context.Context, pool *pgxpool.Pool, days int, now time.Time) (revealStats, error) {
+	var st revealStats
+	err := pool.QueryRow(ctx, `
+select count(*), count(graded_at)
+from reveals
+where user_id = $2
+and revealed_at >= $3::timestamptz - make_interval(days => $1)
+and revealed_at < $3::timestamptz - interval '1 hour'
+`, days, userID(ctx), now).Scan(&st.Reveals, &st.Graded)
+	if err != nil {
+		return st, err
+	}
+	st.Abandoned = st.Reveals - st.Graded
+	if st.Reveals > 0 {
+		st.DropOff = float64(st.Abandoned) / float64(st.Reveals)
+	}
+	return st, nil
+}
+
+// retentionStats is the observed recall rate over a window of reviews,
+// for comparing against the desired retention FSRS schedules for.
+type retentionStats struct {
+	Days      int     `json:"days"`
+	Passed    int     `json:"passed"`
+	Reviews   int     `json:"reviews"`
+	Retention float64 `json:"retention"`
+	Desired   float64 `json:"desired_retention"`
+}
+
+// getRetention counts the reviews of the days days before now and how
+// many were graded Good or Easy. With excludeNew, a card's first review
+// (from the New state) is left out, since there was nothing yet to retain.
+func getRetention(ctx context.Context, pool *pgxpool.Pool, days int, excludeNew bool, now time.Time) (retentionStats, error) {
+	st := retentionStats{Days: days}
+	err := pool.QueryRow(ctx, `
+select count(*) filter (where rating >= 3), count(*)
+from review_log
+where user_id = $1
+and reviewed_at >= $4::timestamptz - make_interval(days => $2)
+and not ($3 and old_state = 0)
+`, userID(ctx), days, excludeNew, now).Scan(&st.Passed, &st.Reviews)
+	if err != nil {
+		return st, err
+	}
+	if st.Reviews > 0 {
+		st.Retention = float64(st.Passed) / float64(st.Reviews)
+	}
+	return st, nil
+}
+
+// scheduling is the part of the configuration that can change while the
+// app runs: how cards are scheduled and queued. POST /admin/reload builds
+// a new one from the environment and swaps it in; everything else (the
+// database, keys, aspects, time zone) is fixed until restart.
+type scheduling struct {
+	// fsrs is built from the configured parameters. Repeat writes a fuzz
+	// seed into the shared Parameters, so calls go through repeat, which
+	// serializes them.
+	fsrs   *fsrs.FSRS
+	fsrsMu sync.Mutex
+	// minRepsBeforeMature and immatureMaxInterval cap intervals for cards
+	// with few reps; see clampImmature.
+	minRepsBeforeMature int
+	immatureMaxInterval time.Duration
+	learnAhead          time.Duration
+	reviewOrder         reviewOrder
+	gradeButtons        gradeButtons
+	leechThreshold      int
+	leechSuspend        bool
+	// newPerDay, rampAfter and rampDays limit new cards; see newCardLimit.
+	newPerDay int
+	rampAfter int
+	rampDays  int
+}
+
+func newScheduling(cfg dbConfig) *scheduling {
+	return &scheduling{
+		fsrs:                fsrs.NewFSRS(cfg.FSRS),
+		minRepsBeforeMature: cfg.MinRepsBeforeMature,
+		immatureMaxInterval: time.Duration(cfg.ImmatureMaxIntervalDays) * 24 * time.Hour,
+		learnAhead:          cfg.LearnAhead,
+		reviewOrder:         cfg.ReviewOrder,
+		gradeButtons:        cfg.GradeButtons,
+		leechThreshold:      cfg.LeechThreshold,
+		leechSuspend:        cfg.LeechSuspend,
+		newPerDay:           cfg.NewCardsPerDay,
+		rampAfter:           cfg.NewCardRampAfterDays,
+		rampDays:            cfg.NewCardRampDays,
+	}
+}
+
+// withParams returns a copy of s that schedules with weights w and
+// desired retention instead of the configured ones.
+func (s *scheduling) withParams(w fsrs.Weights, retention float64) *scheduling {
+	p := s.fsrs.Parameters
+	p.W, p.RequestRetention = w, retention
+	return &scheduling{
+		fsrs:                fsrs.NewFSRS(p),
+		minRepsBeforeMature: s.minRepsBeforeMature,
+		immatureMaxInterval: s.immatureMaxInterval,
+		learnAhead:          s.learnAhead,
+		reviewOrder:         s.reviewOrder,
+		gradeButtons:        s.gradeButtons,
+		leechThreshold:      s.leechThreshold,
+		leechSuspend:        s.leechSuspend,
+		newPerDay:           s.newPerDay,
+		rampAfter:           s.rampAfter,
+		rampDays:            s.rampDays,
+	}
+}
+
+// schedFor returns the scheduling settings for ctx's user: the current
+// ones with the user's own FSRS parameters from user_params, when they
+// have a row.
+func (app *application) schedFor(ctx context.Context) (*scheduling, error) {
+	s := app.sched.Load()
+	w, retention, ok, err := app.cards.UserParams(ctx)
+	if err != nil || !ok {
+		return s, err
+	}
+	return s.withParams(w, retention), nil
+}
+
+// clampImmature deliberately overrides FSRS: until a card has
+// minRepsBeforeMature reps, its next due date is pulled in to at most
+// immatureMaxInterval after now, however long an interval FSRS suggested
+// (even for Easy). Stability and difficulty are kept as FSRS computed them,
+// so the card picks up its real schedule once it passes the gate.
+func (s *scheduling) clampImmature(c *Card, now time.Time) {
+	if s.minRepsBeforeMature == 0 || c.Reps >= s.minRepsBeforeMature {
+		return
+	}
+	if limit := now.Add(s.immatureMaxInterval); c.Due.After(limit) {
+		c.Due = limit
+	}
+}
+
+// dueFromStability sets c.Due from its stored stability and last review
+// alone: the interval at the card's own desired retention, capped by
+// clampImmature as grading capped it at that review, so neither a
+// reschedule nor a recompute lifts a card past the immature gate.
+func (s *scheduling) dueFromStability(c *Card) {
+	ivl := intervalDays(withRetention(s.fsrs.Parameters, c.DesiredRetention), c.Stability)
+	c.Due = c.LastReview.Add(time.Duration(ivl) * 24 * time.Hour)
+	s.clampImmature(c, c.LastReview)
+}
+
+// undoLastReview restores the card touched by the newest review_log row to
+// its pre-review schedule and deletes that row. It returns the restored
+// card's headword and aspect, or ok=false when the log is empty.
+func undoLastReview(ctx context.Context, db txBeginner) (headword, aspect string, ok bool, err error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer tx.Rollback(ctx)
+	var (
+		id         int64
+		c          Card
+		lastReview *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+select id, headword, aspect, old_stability, old_difficulty, old_state, old_lapses, old_reps, old_last_review, old_due
+from review_log
+where user_id = $1
+order by id desc
+limit 1
+for update
+`, userID(ctx)).Scan(&id, &c.Headword, &c.Aspect, &c.Stability, &c.Difficulty, &c.State, &c.Lapses, &c.Reps, &lastReview, &c.Due)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", false, nil
+		}
+		return "", "", false, err
+	}
+	if lastReview != nil {
+		c.LastReview = *lastReview
+	}
+	// Write over whatever version the card is at now; a card deleted
+	// since has nothing to restore.
+	cur, err := lockCard(ctx, tx, c.Headword, c.Aspect)
+	if err != nil {
+		return "", "", false, err
+	}
+	if cur != nil {
+		c.Version = cur.Version
+		if err := saveCard(ctx, tx, c); err != nil {
+			return "", "", false, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `delete from review_log where id = $1`, id); err != nil {
+		return "", "", false, err
+	}
+	return c.Headword, c.Aspect, true, tx.Commit(ctx)
+}
+
+// validRating reports whether g is one of the four grades FSRS schedules.
+// Anything else has no entry in Repeat's RecordLog.
+func validRating(g fsrs.Rating) bool {
+	return g >= fsrs.Again && g <= fsrs.Easy
+}
+
+// repeat runs the scheduler for every rating of c at now.
+func (s *scheduling) repeat(c Card, now time.Time) fsrs.RecordLog {
+	s.fsrsMu.Lock()
+	defer s.fsrsMu.Unlock()
+	return s.fsrs.Repeat(c.mapToFSRS(now), now)
+}
+
+// applyGrade moves c to the schedule FSRS produces for grade at now.
+func (s *scheduling) applyGrade(c *Card, grade fsrs.Rating, now time.Time) {
+	s.applySchedule(c, s.repeat(*c, now)[grade].Card, now)
+}
+
+// applySchedule copies one of FSRS's proposed schedules onto c, subject to
+// the app's own overrides.
+func (s *scheduling) applySchedule(c *Card, result fsrs.Card, now time.Time) {
+	c.Stability = result.Stability
+	c.Difficulty = result.Difficulty
+	c.State = int(result.State)
+	c.Lapses = int(result.Lapses)
+	c.LastReview = result.LastReview
+	c.Due = result.Due
+	c.Reps = int(result.Reps)
+	// FSRS sized the interval for the global retention. Stability doesn't
+	// depend on it, so a card with its own target just needs the interval
+	// redone from the same stability. Learning steps are left alone.
+	if c.DesiredRetention != nil && result.State == fsrs.Review {
+		p := withRetention(s.fsrs.Parameters, c.DesiredRetention)
+		c.Due = now.Add(time.Duration(intervalDays(p, c.Stability)) * 24 * time.Hour)
+	}
+	s.clampImmature(c, now)
+}
+
+// replayReviews rebuilds c's schedule from its logged reviews alone:
+// starting from New, each review is graded again at its own time through
+// applyGrade, as it was graded live. A review logged from the New state
+// starts over there, as the first grade after a reset did.
+func (s *scheduling) replayReviews(c *Card, reviews []historyReview) {
+	for i, rv := range reviews {
+		if i == 0 || rv.fresh {
+			resetSchedule(c, rv.at)
+		}
+		s.applyGrade(c, rv.rating, rv.at)
+	}
+}
+
+// previewIntervals returns how far out each rating on the grade buttons
+// would push c if it were graded at now. It runs the scheduler once and
+// goes through the same applySchedule as a real grade, so the buttons
+// never promise a different interval than grading delivers.
+func (s *scheduling) previewIntervals(c Card, now time.Time) map[fsrs.Rating]time.Duration {
+	log := s.repeat(c, now)
+	ratings := s.gradeButtons.ratings()
+	intervals := make(map[fsrs.Rating]time.Duration, len(ratings))
+	for _, grade := range ratings {
+		next := c
+		s.applySchedule(&next, log[grade].Card, now)
+		intervals[grade] = next.Due.Sub(now)
+	}
+	return intervals
+}
+
+// formatInterval renders an interval the way grade buttons show it:
+// "<1m", "10m", "3h", "8d", "2.5mo", "1.3y".
+func formatInterval(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Round(time.Minute)/time.Minute))
+	case d < day:
+		return fmt.Sprintf("%dh", int(d.Round(time.Hour)/time.Hour))
+	case d < 30*day:
+		return fmt.Sprintf("%dd", int(d.Round(day)/day))
+	case d < 365*day:
+		return fmt.Sprintf("%.1fmo", d.Hours()/24/30)
+	default:
+		return fmt.Sprintf("%.1fy", d.Hours()/24/365)
+	}
+}
+
+// lockCard reads one aspect of a card with a row lock held until tx ends.
+func lockCard(ctx context.Context, tx dbtx, headword, aspect string) (*Card, error) {
+	if aspect == "" || aspect == aspectRecognition {
+		return scanCard(tx.QueryRow(ctx, lockByHeadwordQuery, userID(ctx), headword))
+	}
+	return scanAspectCard(tx.QueryRow(ctx, lockByHeadwordAspectQuery, userID(ctx), headword, aspect))
+}
+
+// gradeCard is the whole read-modify-write of a review in one transaction:
+// lock the card's row, apply grade, write the new schedule and its
+// review_log row. A second grade of the same card blocks on the lock and
+// then builds on the first one's result instead of overwriting it. If
+// check is non-nil it vets the locked card first and its error aborts the
+// grade. It returns nil when the card does not exist.
+func (app *application) gradeCard(ctx context.Context, headword, aspect string, grade fsrs.Rating, now time.Time, check func(Card) error) (*Card, error) {
+	start := time.Now()
+	s, err := app.schedFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var c *Card
+	err = app.cards.InTx(ctx, func(repo CardRepository) error {
+		var err error
+		c, err = app.gradeInTx(ctx, repo, s, headword, aspect, grade, now, check)
+		return err
+	})
+	if err != nil || c == nil {
+		return nil, err
+	}
+	app.queueChanged()
+	app.metrics.reviews.WithLabelValues(grade.String()).Inc()
+	app.metrics.gradeSeconds.Observe(time.Since(start).Seconds())
+	return c, nil
+}
+
+// gradeInTx is gradeCard's work on a repository already inside a
+// transaction, so a batch of grades can share one, scheduling with s.
+func (app *application) gradeInTx(ctx context.Context, repo CardRepository, s *scheduling, headword, aspect string, grade fsrs.Rating, now time.Time, check func(Card) error) (*Card, error) {
+	c, err := repo.Lock(ctx, headword, aspect)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	if check != nil {
+		if err := check(*c); err != nil {
+			return nil, err
+		}
+	}
+	before := *c
+	s.applyGrade(c, grade, now)
+	if err := repo.SaveSchedule(ctx, c); err != nil {
+		return nil, err
+	}
+	if s.leechThreshold > 0 && before.Lapses < s.leechThreshold && c.Lapses >= s.leechThreshold {
+		if err := repo.MarkLeech(ctx, c.Headword, s.leechSuspend); err != nil {
+			return nil, err
+		}
+		c.Suspended = c.Suspended || s.leechSuspend
+		slog.Info("card became a leech", "headword", c.Headword, "aspect", c.Aspect, "lapses", c.Lapses, "suspended", s.leechSuspend)
+	}
+	if err := repo.LogReview(ctx, before, *c, grade, now); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CardRepository is the card storage behind the review flow and the card
+// CRUD handlers. Every method is scoped to userID(ctx). Deck-wide
+// analytics (stats, forecast, reveal logs, settings) still query the pool
+// directly.
+type CardRepository interface {
+	// NextDue returns the next card due at now in order, across the
+	// recognition queue and the enabled extra aspects, limited to the
+	// cards f lets through. Inside InTx the card is
+	// claimed: locked until the transaction ends and skipped by other
+	// transactions' NextDue meanwhile.
+	NextDue(ctx context.Context, order reviewOrder, now time.Time, f queueFilter) (*Card, error)
+	// LearnAhead returns the Learning or Relearning card due soonest, if
+	// one is due by until.
+	LearnAhead(ctx context.Context, until time.Time, f queueFilter) (*Card, error)
+	// Cram returns the card at pos in cram order, due or not.
+	Cram(ctx context.Context, pos int) (*Card, error)
+	// Load fetches one aspect of a card; "" means recognition. A
+	// disabled aspect is treated as not found.
+	Load(ctx context.Context, headword, aspect string) (*Card, error)
+	// Lock is Load with a row lock held until the surrounding InTx ends.
+	Lock(ctx context.Context, headword, aspect string) (*Card, error)
+	// CountDue counts the cards due at now, split into seen and new.
+	CountDue(ctx context.Context, now time.Time) (dueCounts, error)
+	// NextDueAt is when the next card f lets through falls due after
+	// now; ok is false when none will.
+	NextDueAt(ctx context.Context, now time.Time, f queueFilter) (_ time.Time, ok bool, err error)
+	Search(ctx context.Context, q string, limit int) ([]Card, error)
+	// SearchDefinitions is full-text search over the definitions.
+	SearchDefinitions(ctx context.Context, q string, limit int) ([]Card, error)
+	// List pages through the deck, or the cards tagged tag; sort is a
+	// cardSorts key.
+	List(ctx context.Context, sort, tag string, limit, offset int) ([]Card, int, error)
+	// AddTags and RemoveTags change a card's tags and return the new
+	// set, or ok=false when there is no such card.
+	AddTags(ctx context.Context, headword string, tags []string) (_ []string, ok bool, err error)
+	RemoveTags(ctx context.Context, headword string, tags []string) (_ []string, ok bool, err error)
+	Leeches(ctx context.Context) ([]Card, error)
+	Hardest(ctx context.Context, n int) ([]Card, error)
+	// Create adds c as a New card due at now; errCardExists if taken.
+	Create(ctx context.Context, c Card, now time.Time) error
+	// Import adds the cards in a CSV upload; see importCSV.
+	Import(ctx context.Context, src io.Reader, update bool, now time.Time) (importReport, error)
+	// Export and Restore write and read full deck dumps, schedules
+	// included; see exportDeck and restoreDeck.
+	Export(ctx context.Context, fn func(exportedCard) error) error
+	Restore(ctx context.Context, src io.Reader, now time.Time) (importReport, error)
+	// UpdateContent writes the definition fields, never the schedule.
+	UpdateContent(ctx context.Context, c Card) error
+	// SaveSchedule writes the schedule of c's aspect and advances
+	// c.Version, or fails with errStaleCard if the stored version is no
+	// longer c.Version.
+	SaveSchedule(ctx context.Context, c *Card) error
+	LogReview(ctx context.Context, before, after Card, rating fsrs.Rating, at time.Time) error
+	MarkLeech(ctx context.Context, headword string, suspend bool) error
+	// Delete moves a card to the trash and Undelete takes it back out;
+	// see deleteCard.
+	Delete(ctx context.Context, headword string) (bool, error)
+	Undelete(ctx context.Context, headword string) (bool, error)
+	Trash(ctx context.Context) ([]trashedCard, error)
+	ToggleSuspended(ctx context.Context, headword string) (suspended, ok bool, err error)
+	// UndoLast reverts the newest logged review; see undoLastReview.
+	UndoLast(ctx context.Context) (headword, aspect string, ok bool, err error)
+	// ReviewDays returns the dates in loc with reviews; see reviewDays.
+	ReviewDays(ctx context.Context, loc *time.Location) ([]time.Time, error)
+	// CountIntroduced counts the New cards graded since since.
+	CountIntroduced(ctx context.Context, since time.Time) (int, error)
+	// ReviewLog returns the logged reviews of every card, or of
+	// headword's aspects alone when it isn't ""; see getLoggedReviews.
+	ReviewLog(ctx context.Context, headword string) ([]loggedCard, error)
+	// UserParams returns the user's own FSRS weights and retention, or
+	// ok=false to schedule with the configured ones; see getUserParams.
+	UserParams(ctx context.Context) (w fsrs.Weights, retention float64, ok bool, err error)
+	// InTx runs fn against a repository bound to one transaction, which
+	// commits if fn returns nil. Nested InTx calls are savepoints.
+	InTx(ctx context.Context, fn func(CardRepository) error) error
+}
+
+// pgxCardRepo is the Postgres CardRepository. db is the pool, or a
+// transaction inside InTx, in which case inTx is set.
+type pgxCardRepo struct {
+	db      txBeginner
+	aspects []string
+	inTx    bool
+}
+
+func (r pgxCardRepo) NextDue(ctx context.Context, order reviewOrder, now time.Time, f queueFilter) (*Card, error) {
+	card, err := getNextDueCard(ctx, r.db, order, now, f, r.inTx)
+	if err != nil || len(r.aspects) == 0 {
+		return card, err
+	}
+	aspectCard, err := getNextDueAspectCard(ctx, r.db, r.aspects, order, now, f, r.inTx)
+	if err != nil {
+		return nil, err
+	}
+	if card == nil || aspectCard == nil {
+		return cmp.Or(card, aspectCard), nil
+	}
+	// Pick between the two queues' heads the way order would have: the
+	// one waiting longest, the more frequent, or either at random.
+	var takeAspect bool
+	switch order {
+	case orderFreq:
+		takeAspect = aspectCard.Freq > card.Freq
+	case orderRandom:
+		takeAspect = mrand.IntN(2) == 0
+	default:
+		takeAspect = aspectCard.Due.Before(card.Due)
+	}
+	if takeAspect {
+		return aspectCard, nil
+	}
+	return card, nil
+}
+
+func (r pgxCardRepo) LearnAhead(ctx context.Context, until time.Time, f queueFilter) (*Card, error) {
+	card, err := getLearnAheadCard(ctx, r.db, until, f, r.inTx)
+	if err != nil || len(r.aspects) == 0 {
+		return card, err
+	}
+	aspectCard, err := getLearnAheadAspectCard(ctx, r.db, r.aspects, until, f, r.inTx)
+	if err != nil {
+		return nil, err
+	}
+	if card == nil || (aspectCard != nil && aspectCard.Due.Before(card.Due)) {
+		return aspectCard, nil
+	}
+	return card, nil
+}
+
+func (r pgxCardRepo) Cram(ctx context.Context, pos int) (*Card, error) {
+	return getCramCard(ctx, r.db, pos)
+}
+
+func (r pgxCardRepo) Load(ctx context.Context, headword, aspect string) (*Card, error) {
+	if aspect == "" || aspect == aspectRecognition {
+		return getCardByHeadword(ctx, r.db, headword)
+	}
+	if !slices.Contains(r.aspects, aspect) {
+		return nil, nil
+	}
+	return getAspectCard(ctx, r.db, headword, aspect)
+}
+
+func (r pgxCardRepo) Lock(ctx context.Context, headword, aspect string) (*Card, error) {
+	if aspect != "" && aspect != aspectRecognition && !slices.Contains(r.aspects, aspect) {
+		return nil, nil
+	}
+	return lockCard(ctx, r.db, headword, aspect)
+}
+
+func (r pgxCardRepo) CountDue(ctx context.Context, now time.Time) (dueCounts, error) {
+	return countDue(ctx, r.db, r.aspects, now)
+}
+
+func (r pgxCardRepo) NextDueAt(ctx context.Context, now time.Time, f queueFilter) (time.Time, bool, error) {
+	return nextDueAt(ctx, r.db, r.aspects, now, f)
+}
+
+func (r pgxCardRepo) Search(ctx context.Context, q string, limit int) ([]Card, error) {
+	return searchCards(ctx, r.db, q, limit)
+}
+
+func (r pgxCardRepo) SearchDefinitions(ctx context.Context, q string, limit int) ([]Card, error) {
+	return searchDefinitions(ctx, r.db, q, limit)
+}
+
+func (r pgxCardRepo) List(ctx context.Context, sort, tag string, limit, offset int) ([]Card, int, error) {
+	return listCards(ctx, r.db, sort, tag, limit, offset)
+}
+
+func (r pgxCardRepo) AddTags(ctx context.Context, headword string, tags []string) ([]string, bool, error) {
+	return updateTags(ctx, r.db, headword, `array(select distinct t from unnest(tags || $3::text[]) t order by t)`, tags)
+}
+
+func (r pgxCardRepo) RemoveTags(ctx context.Context, headword string, tags []string) ([]string, bool, error) {
+	return updateTags(ctx, r.db, headword, `array(select t from unnest(tags) t where t <> all($3::text[]) order by t)`, tags)
+}
+
+func (r pgxCardRepo) Leeches(ctx context.Context) ([]Card, error) {
+	return getLeeches(ctx, r.db)
+}
+
+func (r pgxCardRepo) Hardest(ctx context.Context, n int) ([]Card, error) {
+	return getHardest(ctx, r.db, n)
+}
+
+func (r pgxCardRepo) Create(ctx context.Context, c Card, now time.Time) error {
+	return insertCard(ctx, r.db, c, r.aspects, now)
+}
+
+func (r pgxCardRepo) Import(ctx context.Context, src io.Reader, update bool, now time.Time) (importReport, error) {
+	return importCSV(ctx, r.db, src, update, r.aspects, now)
+}
+
+func (r pgxCardRepo) Export(ctx context.Context, fn func(exportedCard) error) error {
+	return exportDeck(ctx, r.db, fn)
+}
+
+func (r pgxCardRepo) Restore(ctx context.Context, src io.Reader, now time.Time) (importReport, error) {
+	return restoreDeck(ctx, r.db, src, now)
+}
+
+func (r pgxCardRepo) UpdateContent(ctx context.Context, c Card) error {
+	return updateCardContent(ctx, r.db, c)
+}
+
+func (r pgxCardRepo) SaveSchedule(ctx context.Context, c *Card) error {
+	if err := saveCard(ctx, r.db, *c); err != nil {
+		return err
+	}
+	c.Version++
+	return nil
+}
+
+func (r pgxCardRepo) LogReview(ctx context.Context, before, after Card, rating fsrs.Rating, at time.Time) error {
+	return writeReviewLog(ctx, r.db, before, after, rating, at)
+}
+
+func (r pgxCardRepo) MarkLeech(ctx context.Context, headword string, suspend bool) error {
+	return markLeech(ctx, r.db, headword, suspend)
+}
+
+func (r pgxCardRepo) Delete(ctx context.Context, headword string) (bool, error) {
+	return deleteCard(ctx, r.db, headword)
+}
+
+func (r pgxCardRepo) Undelete(ctx context.Context, headword string) (bool, error) {
+	return undeleteCard(ctx, r.db, headword)
+}
+
+func (r pgxCardRepo) Trash(ctx context.Context) ([]trashedCard, error) {
+	return getTrash(ctx, r.db)
+}
+
+func (r pgxCardRepo) ToggleSuspended(ctx context.Context, headword string) (bool, bool, error) {
+	return toggleSuspended(ctx, r.db, headword)
+}
+
+func (r pgxCardRepo) UndoLast(ctx context.Context) (string, string, bool, error) {
+	return undoLastReview(ctx, r.db)
+}
+
+func (r pgxCardRepo) ReviewDays(ctx context.Context, loc *time.Location) ([]time.Time, error) {
+	return reviewDays(ctx, r.db, loc)
+}
+
+func (r pgxCardRepo) CountIntroduced(ctx context.Context, since time.Time) (int, error) {
+	return countIntroduced(ctx, r.db, since)
+}
+
+func (r pgxCardRepo) ReviewLog(ctx context.Context, headword string) ([]loggedCard, error) {
+	return getLoggedReviews(ctx, r.db, headword)
+}
+
+func (r pgxCardRepo) UserParams(ctx context.Context) (fsrs.Weights, float64, bool, error) {
+	return getUserParams(ctx, r.db)
+}
+
+func (r pgxCardRepo) InTx(ctx context.Context, fn func(CardRepository) error) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := fn(pgxCardRepo{db: tx, aspects: r.aspects, inTx: true}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// saveCard writes a card's schedule back to wherever its aspect lives.
+func saveCard(ctx context.Context, db dbtx, c Card) error {
+	if c.Aspect != "" && c.Aspect != aspectRecognition {
+		return updateAspectInDB(ctx, db, c)
+	}
+	return updateCardInDB(ctx, db, c)
+}
+
+// writeReviewLog records one grade: the card's schedule before and after.
+// Call it in the same transaction as saveCard so the two never diverge.
+func writeReviewLog(ctx context.Context, db dbtx, before, after Card, rating fsrs.Rating, reviewedAt time.Time) error {
+	const insertSQL = `
+insert into review_log (
+user_id, headword, aspect, rating,
+old_stability, new_stability,
+old_difficulty, new_difficulty,
+old_state, new_state,
+old_lapses, old_reps, old_last_review,
+old_due, new_due,
+reviewed_at
+) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+`
+	_, err := db.Exec(ctx, insertSQL,
+		userID(ctx), after.Headword, after.Aspect, int(rating),
+		before.Stability, after.Stability,
+		before.Difficulty, after.Difficulty,
+		before.State, after.State,
+		before.Lapses, before.Reps, before.LastReview,
+		before.Due, after.Due,
+		reviewedAt,
+	)
+	return err
+}
+
+// reviewPage is the data for front.html: the card plus queue context.
+type reviewPage struct {
+	*Card
+	Token    string
+	DueCount int
+	// Cram is set on /cram pages; Note reports the previous dry-run grade.
+	Cram bool
+	Note string
+}
+
+// reviewToken identifies the card a review page was rendered for, and the
+// state it was in: Reps and Version pin the exact schedule, so a grade
+// submitted after the card moved on (graded elsewhere, double submit,
+// queue advanced, rescheduled) no longer matches and is rejected instead
+// of grading the wrong state.
+type reviewToken struct {
+	User     string `json:"u"`
+	Headword string `json:"h"`
+	Aspect   string `json:"a"`
+	Reps     int    `json:"r"`
+	Version  int    `json:"v,omitempty"`
+	Issued   int64  `json:"t"`
+	// Cram marks a card shown by /cram, whose grade is a dry run; Pos is
+	// its place in the cram order.
+	Cram bool `json:"c,omitempty"`
+	Pos  int  `json:"p,omitempty"`
+	// Order, HSK and Tag are the ?order=, ?hsk= and ?tag= the review
+	// page was opened with, so grading returns to the same queue.
+	Order reviewOrder `json:"o,omitempty"`
+	HSK   int         `json:"k,omitempty"`
+	Tag   string      `json:"g,omitempty"`
+}
+
+// cardToken is the token for showing c to user in normal review.
+func cardToken(user string, c Card) reviewToken {
+	return reviewToken{User: user, Headword: c.Headword, Aspect: c.Aspect, Reps: c.Reps, Version: c.Version}
+}
+
+var (
+	errTokenInvalid = errors.New("invalid review token")
+	errTokenExpired = errors.New("review token expired")
+	errStaleCard    = errors.New("card changed since it was shown")
+)
+
+func (app *application) tokenMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, app.tokenKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// signToken issues tok, stamped with now, for embedding in review forms.
+func (app *application) signToken(tok reviewToken, now time.Time) string {
+	tok.Issued = now.Unix()
+	payload, _ := json.Marshal(tok)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(app.tokenMAC(payload))
+}
+
+// verifyToken checks a token's signature and age, and that it was issued
+// to user.
+func (app *application) verifyToken(s, user string, now time.Time) (reviewToken, error) {
+	var tok reviewToken
+	enc := base64.RawURLEncoding
+	p, m, ok := strings.Cut(s, ".")
+	if !ok {
+		return tok, errTokenInvalid
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return tok, errTokenInvalid
+	}
+	mac, err := enc.DecodeString(m)
+	if err != nil || !hmac.Equal(mac, app.tokenMAC(payload)) {
+		return tok, errTokenInvalid
+	}
+	if err := json.Unmarshal(payload, &tok); err != nil || tok.User != user {
+		return tok, errTokenInvalid
+	}
+	if now.Sub(time.Unix(tok.Issued, 0)) > app.tokenTTL {
+		return tok, errTokenExpired
+	}
+	return tok, nil
+}
+
+// revealPage is the data for back.html: the card plus the interval each
+// grade button would schedule.
+type revealPage struct {
+	*Card
+	Token     string
+	Cram      bool
+	Audio     bool
+	Intervals map[fsrs.Rating]time.Duration
+	History   []historyEntry
+}
+
+// AudioURL is where the headword's speech is served.
+func (p revealPage) AudioURL() string {
+	return "/audio/" + url.PathEscape(p.Headword)
+}
+
+// Shows reports whether rating has a button, for use as {{if .Shows 2}}.
+// The buttons are the ratings that were previewed.
+func (p revealPage) Shows(rating int) bool {
+	_, ok := p.Intervals[fsrs.Rating(rating)]
+	return ok
+}
+
+// Interval formats the preview for rating, for use as {{.Interval 3}}.
+func (p revealPage) Interval(rating int) string {
+	return formatInterval(p.Intervals[fsrs.Rating(rating)])
+}
+
+// nextDue picks the card to review now. The scheduler's short-term steps
+// put a failed or still-learning card's due_at minutes out (1m, 5m, 10m)
+// rather than days, so it comes back within the session; the queue
+// itself is only ever due_at, with no in-memory state. When nothing is
+// due yet, the Learning or Relearning card due soonest within learnAhead
+// is shown early rather than ending the session while a step is pending.
+// New cards are held back once the day's limit is used up.
+// Results are cached in nextDueCache, except in random order, where each
+// call should draw afresh.
+func (app *application) nextDue(ctx context.Context, order reviewOrder, f queueFilter) (*Card, error) {
+	now := app.clock.Now()
+	s := app.sched.Load()
+	learnAhead := s.learnAhead
+	load := func(ctx context.Context) (*Card, error) {
+		left, err := app.newCardsLeft(ctx, s, now)
+		if err != nil {
+			return nil, err
+		}
+		qf := f
+		qf.NoNew = left == 0
+		card, err := app.cards.NextDue(ctx, order, now, qf)
+		if err != nil || card != nil || learnAhead == 0 {
+			return card, err
+		}
+		return app.cards.LearnAhead(ctx, now.Add(learnAhead), f)
+	}
+	if order == orderRandom || app.nextDueCache.ttl == 0 {
+		return load(ctx)
+	}
+	key := nextDueKey{user: userID(ctx), order: order, f: f}
+	return app.nextDueCache.get(ctx, key, now, func(ctx context.Context) (*Card, time.Time, error) {
+		card, err := load(ctx)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		expires := now.Add(app.nextDueCache.ttl)
+		next, ok, err := app.cards.NextDueAt(ctx, now, f)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if ok {
+			expires = minTime(expires, next.Add(-learnAhead))
+		}
+		return card, expires, nil
+	})
+}
+
+// newCardsLeft is how many more New cards the queue may introduce today
+// under s, or -1 when there is no limit.
+func (app *application) newCardsLeft(ctx context.Context, s *scheduling, now time.Time) (int, error) {
+	if s.newPerDay == 0 {
+		return -1, nil
+	}
+	y, m, d := now.In(app.timezone).Date()
+	limit := s.newPerDay
+	if s.rampAfter > 0 {
+		days, err := app.cards.ReviewDays(ctx, app.timezone)
+		if err != nil {
+			return 0, err
+		}
+		limit = s.newCardLimit(days, time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+	}
+	n, err := app.cards.CountIntroduced(ctx, time.Date(y, m, d, 0, 0, 0, 0, app.timezone))
+	if err != nil {
+		return 0, err
+	}
+	return max(limit-n, 0), nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func (app *application) handleReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	defaultOrder := app.sched.Load().reviewOrder
+	order := defaultOrder
+	if v := r.URL.Query().Get("order"); v != "" {
+		o, err := parseReviewOrder(v)
+		if err != nil {
+			app.renderError(w, http.StatusBadRequest, "order must be due, freq or random.")
+			return
+		}
+		order = o
+	}
+	hsk, err := parseHSKLevel(r.URL.Query().Get("hsk"))
+	if err != nil {
+		app.renderError(w, http.StatusBadRequest, "hsk must be a level from 1 to 9.")
+		return
+	}
+	tag, err := parseTag(r.URL.Query().Get("tag"))
+	if err != nil {
+		app.renderError(w, http.StatusBadRequest, "tag "+err.Error()+".")
+		return
+	}
+	card, err := app.nextDue(r.Context(), order, queueFilter{HSK: hsk, Tag: tag})
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if card == nil {
+		// The queue is empty, so the session is over: sum it up, say when
+		// the next card comes due and start the next session from zero.
+		now := app.clock.Now()
+		page := summaryPage{sessionTally: app.readTally(r, now), Now: now.In(app.timezone)}
+		next, ok, err := app.cards.NextDueAt(r.Context(), now, queueFilter{HSK: hsk, Tag: tag})
+		if err != nil {
+			app.dbError(w, r, err)
+			return
+		}
+		if ok {
+			page.NextDue = next
+		}
+		app.writeTally(w, r, sessionTally{})
+		if err := app.render(w, r, "summary.html", page); err != nil {
+			app.templateError(w, r, err)
+		}
+		return
+	}
+	due, err := app.dueCountNow(r.Context())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	tok := cardToken(userID(r.Context()), *card)
+	if order != defaultOrder {
+		tok.Order = order
+	}
+	tok.HSK, tok.Tag = hsk, tag
+	if err := app.render(w, r, "front.html", reviewPage{Card: card, Token: app.signToken(tok, app.clock.Now()), DueCount: due}); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+func (app *application) handleReveal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.renderError(w, http.StatusBadRequest, "The form could not be read. Go back and try again.")
+		return
+	}
+	token := r.FormValue("token")
+	tok, err := app.verifyToken(token, userID(r.Context()), app.clock.Now())
+	if err != nil {
+		http.Redirect(w, r, "/review", http.StatusSeeOther)
+		return
+	}
+	card, err := app.cards.Load(r.Context(), tok.Headword, tok.Aspect)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if card == nil || card.Reps != tok.Reps {
+		http.Redirect(w, r, "/review", http.StatusSeeOther)
+		return
+	}
+	if app.logReveals && !tok.Cram {
+		if err := logReveal(r.Context(), app.db, sessionID(w, r), *card, app.clock.Now()); err != nil {
+			slog.Warn("reveal log failed", "headword", card.Headword, "err", err)
+		}
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	history, err := getCardHistory(r.Context(), app.readDB, card.Headword, card.Aspect)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	page := revealPage{Card: card, Token: token, Cram: tok.Cram, Audio: app.tts != nil, Intervals: sched.previewIntervals(*card, app.clock.Now()), History: history}
+	if err := app.render(w, r, "back.html", page); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// gradeDebounce remembers when each card was last graded on this
+// instance, so a second grade of the same card within window (a double
+// tap on mobile) can be refused before it is applied on top of the first.
+type gradeDebounce struct {
+	mu     sync.Mutex
+	window time.Duration
+	last   map[gradeKey]time.Time
+}
+
+type gradeKey struct {
+	user, headword, aspect string
+}
+
+// allow reports whether a grade of k at now is clear of the previous
+// one, and if so records it, so a second tap arriving while the first is
+// still being saved is refused too. A grade that then fails must be
+// taken back with forget. A zero window allows everything.
+func (d *gradeDebounce) allow(k gradeKey, now time.Time) bool {
+	if d.window <= 0 {
+		return true
+	}
+	k.aspect = cmp.Or(k.aspect, aspectRecognition)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.last[k]; ok && now.Sub(t) < d.window {
+		return false
+	}
+	if d.last == nil {
+		d.last = map[gradeKey]time.Time{}
+	}
+	d.last[k] = now
+	return true
+}
+
+// forget takes back the grade allow recorded for k at at, when it wasn't
+// saved after all, so retrying it isn't refused as a double tap.
+func (d *gradeDebounce) forget(k gradeKey, at time.Time) {
+	k.aspect = cmp.Or(k.aspect, aspectRecognition)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.last[k]; ok && t.Equal(at) {
+		delete(d.last, k)
+	}
+}
+
+// sweepEvery drops grades older than the window, as clk tells time,
+// every interval until ctx ends, so the map only holds the cards graded
+// in the last moment.
+func (d *gradeDebounce) sweepEvery(ctx context.Context, clk clock, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := clk.Now()
+		d.mu.Lock()
+		maps.DeleteFunc(d.last, func(_ gradeKey, at time.Time) bool {
+			return now.Sub(at) >= d.window
+		})
+		d.mu.Unlock()
+	}
+}
+
+func (app *application) handleGrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		app.renderError(w, http.StatusBadRequest, "The form could not be read. Go back and try again.")
+		return
+	}
+	tok, err := app.verifyToken(r.FormValue("token"), userID(r.Context()), app.clock.Now())
+	if err != nil {
+		app.renderError(w, http.StatusBadRequest, "This card was shown too long ago. Go back to review to pick up where you left off.")
+		return
+	}
+	// The form only takes the ratings it shows; /api/grade takes any.
+	buttons := app.sched.Load().gradeButtons
+	ratingInt, err := strconv.Atoi(r.FormValue("rating"))
+	grade := fsrs.Rating(ratingInt)
+	if err != nil || !slices.Contains(buttons.ratings(), grade) {
+		app.renderError(w, http.StatusBadRequest, "The rating must be "+buttons.ratingChoices()+".")
+		return
+	}
+	if tok.Cram {
+		app.cramGrade(w, r, tok, grade)
+		return
+	}
+	gradedAt := app.clock.Now()
+	key := gradeKey{userID(r.Context()), tok.Headword, tok.Aspect}
+	if !app.debounce.allow(key, gradedAt) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(app.debounce.window.Seconds()))))
+		app.renderError(w, http.StatusTooManyRequests, "This card was graded a moment ago. Go back to review to continue.")
+		return
+	}
+	currentCard, err := app.gradeCard(r.Context(), tok.Headword, tok.Aspect, grade, gradedAt, func(c Card) error {
+		if c.Reps != tok.Reps || c.Version != tok.Version {
+			return errStaleCard
+		}
+		return nil
+	})
+	if err != nil || currentCard == nil {
+		app.debounce.forget(key, gradedAt)
+	}
+	if errors.Is(err, errStaleCard) {
+		app.renderError(w, http.StatusConflict, "This card changed since it was shown. Go back to review to refresh.")
+		return
+	}
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if currentCard == nil {
+		app.renderError(w, http.StatusNotFound, "This card no longer exists.")
+		return
+	}
+	if app.logReveals {
+		if err := markRevealGraded(r.Context(), app.db, sessionID(w, r), *currentCard, gradedAt); err != nil {
+			slog.Warn("reveal log failed", "headword", currentCard.Headword, "err", err)
+		}
+	}
+	now := app.clock.Now()
+	tally := app.readTally(r, now)
+	tally.Ratings[grade-1]++
+	tally.Undo, tally.Last = int(grade), now.Unix()
+	app.writeTally(w, r, tally)
+	next := "/review"
+	q := url.Values{}
+	if tok.Order != "" {
+		q.Set("order", string(tok.Order))
+	}
+	if tok.HSK != 0 {
+		q.Set("hsk", strconv.Itoa(tok.HSK))
+	}
+	if tok.Tag != "" {
+		q.Set("tag", tok.Tag)
+	}
+	if len(q) > 0 {
+		next += "?" + q.Encode()
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// handleCram drills the deck regardless of due dates, hardest first,
+// starting from position ?n=. It shares /reveal and /grade with normal
+// review, but the token marks the card as crammed so grading it is a dry
+// run: see cramGrade.
+func (app *application) handleCram(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	pos, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	pos = max(pos, 0)
+	card, err := app.cards.Cram(r.Context(), pos)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if card == nil {
+		page := errorPage{Title: "Cram finished", Message: "You went through the whole deck."}
+		if err := app.render(w, r, "error.html", page); err != nil {
+			app.templateError(w, r, err)
+		}
+		return
+	}
+	due, err := app.dueCountNow(r.Context())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	tok := cardToken(userID(r.Context()), *card)
+	tok.Cram, tok.Pos = true, pos
+	page := reviewPage{
+		Card:     card,
+		Token:    app.signToken(tok, app.clock.Now()),
+		DueCount: due,
+		Cram:     true,
+		Note:     r.URL.Query().Get("note"),
+	}
+	if err := app.render(w, r, "front.html", page); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// cramGrade is handleGrade for a crammed card: it works out where grade
+// would have scheduled the card but saves nothing (no schedule update, no
+// review_log row), so cramming never disturbs the real schedule. The
+// would-be interval is shown on the next cram card.
+func (app *application) cramGrade(w http.ResponseWriter, r *http.Request, tok reviewToken, grade fsrs.Rating) {
+	card, err := app.cards.Load(r.Context(), tok.Headword, tok.Aspect)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if card == nil {
+		app.renderError(w, http.StatusNotFound, "This card no longer exists.")
+		return
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	now := app.clock.Now()
+	sched.applyGrade(card, grade, now)
+	q := url.Values{}
+	q.Set("n", strconv.Itoa(tok.Pos+1))
+	q.Set("note", fmt.Sprintf("%s would be due in %s (not saved)", tok.Headword, formatInterval(card.Due.Sub(now))))
+	http.Redirect(w, r, "/cram?"+q.Encode(), http.StatusSeeOther)
+}
+
+// handleUndo reverts the most recent grade and shows the card's front again
+// so it can be re-graded straight away.
+func (app *application) handleUndo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		app.methodNotAllowed(w)
+		return
+	}
+	headword, aspect, ok, err := app.cards.UndoLast(r.Context())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if !ok {
+		page := errorPage{Title: "Nothing to undo", Message: "There is no grade left to undo."}
+		if err := app.render(w, r, "error.html", page); err != nil {
+			app.templateError(w, r, err)
+		}
+		return
+	}
+	app.queueChanged()
+	if tally := app.readTally(r, app.clock.Now()); tally.Undo != 0 {
+		tally.Ratings[tally.Undo-1]--
+		tally.Undo = 0
+		app.writeTally(w, r, tally)
+	}
+	card, err := app.cards.Load(r.Context(), headword, aspect)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if card == nil {
+		http.Redirect(w, r, "/review", http.StatusSeeOther)
+		return
+	}
+	due, err := app.dueCountNow(r.Context())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if err := app.render(w, r, "front.html", reviewPage{Card: card, Token: app.signToken(cardToken(userID(r.Context()), *card), app.clock.Now()), DueCount: due}); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// apiCard is a Card as served to JSON clients, with how long it has been
+// since the last review and how far past due it is.
+type apiCard struct {
+	Card
+	ElapsedDays float64 `json:"elapsed_days"`
+	OverdueDays float64 `json:"overdue_days"`
+}
+
+func newAPICard(c Card, now time.Time) apiCard {
+	ac := apiCard{Card: c}
+	if c.State != int(fsrs.New) && !c.LastReview.IsZero() {
+		ac.ElapsedDays = math.Max(now.Sub(c.LastReview).Hours()/24, 0)
+	}
+	ac.OverdueDays = math.Max(now.Sub(c.Due).Hours()/24, 0)
+	return ac
+}
+
+// handleDueCount answers {"due": N, "new": M}: the cards seen before that
+// are due now, and the never-reviewed ones available now, with nothing
+// else, for a client's badge to poll. It is served from dueCountCache.
+func (app *application) handleDueCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	counts, err := app.dueCountsNow(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// handleAPINext is the JSON twin of handleReview: same queue. When
+// nothing is due it answers {"next_due_at", "due_in_seconds"} instead of a
+// card, or 204 when no card is scheduled at all.
+func (app *application) handleAPINext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	order := app.sched.Load().reviewOrder
+	if v := r.URL.Query().Get("order"); v != "" {
+		o, err := parseReviewOrder(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "order must be due, freq or random")
+			return
+		}
+		order = o
+	}
+	hsk, err := parseHSKLevel(r.URL.Query().Get("hsk"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "hsk must be a level from 1 to 9")
+		return
+	}
+	tag, err := parseTag(r.URL.Query().Get("tag"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "tag "+err.Error())
+		return
+	}
+	f := queueFilter{HSK: hsk, Tag: tag}
+	card, err := app.nextDue(r.Context(), order, f)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if card == nil {
+		// Nothing is due: say when something will be, or 204 if nothing
+		// is scheduled at all.
+		now := app.clock.Now()
+		next, ok, err := app.cards.NextDueAt(r.Context(), now, f)
+		if err != nil {
+			jsonDBError(w, r, "db error", err)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"next_due_at":    next,
+			"due_in_seconds": int(math.Ceil(next.Sub(now).Seconds())),
+		})
+		return
+	}
+	setLastModified(w, *card)
+	if notModified(w, r, cardsETag(*card)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPICard(*card, app.clock.Now()))
+}
+
+// batchGradeItem is one offline review in a /api/grade/batch body.
+type batchGradeItem struct {
+	Headword   string    `json:"headword"`
+	Aspect     string    `json:"aspect"`
+	Rating     int       `json:"rating"`
+	ReviewedAt time.Time `json:"reviewed_at"`
+}
+
+type batchGradeResult struct {
+	Headword string   `json:"headword"`
+	Aspect   string   `json:"aspect,omitempty"`
+	OK       bool     `json:"ok"`
+	Error    string   `json:"error,omitempty"`
+	Card     *apiCard `json:"card,omitempty"`
+}
+
+// maxBatchGrades caps one /api/grade/batch request.
+const maxBatchGrades = 500
+
+var errReviewedBeforeLast = errors.New("reviewed_at is before the card's last review")
+
+// handleAPIGradeBatch replays a JSON array of offline reviews
+// [{"headword", "aspect", "rating", "reviewed_at"}], in order, in one
+// transaction. Each grade is scheduled at its own reviewed_at rather than
+// now, so FSRS sees the real elapsed time. Items run in savepoints: one
+// that fails is reported in its result and the rest still apply.
+func (app *application) handleAPIGradeBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var items []batchGradeItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if len(items) > maxBatchGrades {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d grades per batch", maxBatchGrades))
+		return
+	}
+	ctx := r.Context()
+	now := app.clock.Now()
+	s, err := app.schedFor(ctx)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	results := make([]batchGradeResult, len(items))
+	err = app.cards.InTx(ctx, func(repo CardRepository) error {
+		for i, it := range items {
+			app.gradeBatchItem(ctx, repo, s, it, now, &results[i])
+		}
+		return nil
+	})
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	app.queueChanged()
+	for i, res := range results {
+		if res.OK {
+			app.metrics.reviews.WithLabelValues(fsrs.Rating(items[i].Rating).String()).Inc()
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+// gradeBatchItem validates and grades one batch item in a savepoint of
+// repo's transaction, filling in res. Replaying a review older than the
+// card's last one would run FSRS backwards in time, so that is refused.
+func (app *application) gradeBatchItem(ctx context.Context, repo CardRepository, s *scheduling, it batchGradeItem, now time.Time, res *batchGradeResult) {
+	res.Headword, res.Aspect = it.Headword, it.Aspect
+	grade := fsrs.Rating(it.Rating)
+	switch {
+	case it.Headword == "":
+		res.Error = "headword is required"
+	case !validRating(grade):
+		res.Error = "rating must be between 1 and 4"
+	case it.ReviewedAt.IsZero():
+		res.Error = "reviewed_at is required"
+	case it.ReviewedAt.After(now.Add(5 * time.Minute)):
+		res.Error = "reviewed_at is in the future"
+	}
+	if res.Error != "" {
+		return
+	}
+	var card *Card
+	err := repo.InTx(ctx, func(sp CardRepository) error {
+		var err error
+		card, err = app.gradeInTx(ctx, sp, s, it.Headword, it.Aspect, grade, it.ReviewedAt, func(c Card) error {
+			if c.State != int(fsrs.New) && it.ReviewedAt.Before(c.LastReview) {
+				return errReviewedBeforeLast
+			}
+			return nil
+		})
+		return err
+	})
+	switch {
+	case errors.Is(err, errReviewedBeforeLast):
+		res.Error = err.Error()
+	case err != nil:
+		slog.Error("batch grade failed", "headword", it.Headword, "err", err)
+		res.Error = "save failed"
+	case card == nil:
+		res.Error = "card not found"
+	default:
+		c := newAPICard(*card, now)
+		res.OK, res.Card = true, &c
+	}
+}
+
+// handleAPIGrade grades a card from a JSON body
+// {"headword": "...", "rating": 1-4, "aspect": "..."} and returns its new
+// schedule, including the interval in days until it is due again.
+func (app *application) handleAPIGrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body struct {
+		Headword string `json:"headword"`
+		Rating   int    `json:"rating"`
+		Aspect   string `json:"aspect"`
+		// Version, when sent, is the card version the client last saw;
+		// a grade over a newer one is a 409.
+		Version *int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if body.Headword == "" {
+		writeJSONError(w, http.StatusBadRequest, "headword is required")
+		return
+	}
+	grade := fsrs.Rating(body.Rating)
+	if !validRating(grade) {
+		writeJSONError(w, http.StatusBadRequest, "rating must be between 1 and 4")
+		return
+	}
+	now := app.clock.Now()
+	key := gradeKey{userID(r.Context()), body.Headword, body.Aspect}
+	if !app.debounce.allow(key, now) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(app.debounce.window.Seconds()))))
+		writeJSONError(w, http.StatusTooManyRequests, "card was graded a moment ago")
+		return
+	}
+	var check func(Card) error
+	if body.Version != nil {
+		check = func(c Card) error {
+			if c.Version != *body.Version {
+				return errStaleCard
+			}
+			return nil
+		}
+	}
+	card, err := app.gradeCard(r.Context(), body.Headword, body.Aspect, grade, now, check)
+	if err != nil || card == nil {
+		app.debounce.forget(key, now)
+	}
+	if errors.Is(err, errStaleCard) {
+		writeJSONError(w, http.StatusConflict, "card changed, refresh")
+		return
+	}
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		apiCard
+		IntervalDays float64 `json:"interval_days"`
+	}{
+		apiCard:      newAPICard(*card, now),
+		IntervalDays: card.Due.Sub(now).Hours() / 24,
+	})
+}
+
+// statsPage is the data for stats.html and the ?format=json response.
+// Reveals is only filled in when reveal logging is on.
+type statsPage struct {
+	deckStats
+	ByHSK   []hskStats   `json:"by_hsk"`
+	Reveals *revealStats `json:"reveals,omitempty"`
+}
+
+func (app *application) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	now := app.clock.Now()
+	st, err := getDeckStats(r.Context(), app.readDB, now)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	byHSK, err := getHSKStats(r.Context(), app.readDB, now)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	page := statsPage{deckStats: st, ByHSK: byHSK}
+	if app.logReveals {
+		rs, err := getRevealStats(r.Context(), app.readDB, 30, now)
+		if err != nil {
+			app.dbError(w, r, err)
+			return
+		}
+		page.Reveals = &rs
+	}
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	if err := app.render(w, r, "stats.html", page); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// maxCardsPage caps ?limit= on /cards.
+const maxCardsPage = 200
+
+// cardsPage is the data for cards.html and the ?format=json response.
+type cardsPage struct {
+	Cards  []Card `json:"cards"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Sort   string `json:"sort"`
+	Tag    string `json:"tag,omitempty"`
+}
+
+// Sorts lists the ?sort= values in the order the page offers them.
+func (cardsPage) Sorts() []string {
+	return []string{"freq", "headword", "due", "difficulty", "stability", "lapses"}
+}
+
+// First and Last number the cards shown, counting from 1.
+func (p cardsPage) First() int { return p.Offset + 1 }
+func (p cardsPage) Last() int  { return p.Offset + len(p.Cards) }
+
+// PrevOffset and NextOffset are the offsets of the neighbouring pages;
+// -1 means there is none.
+func (p cardsPage) PrevOffset() int {
+	if p.Offset == 0 {
+		return -1
+	}
+	return max(p.Offset-p.Limit, 0)
+}
+
+func (p cardsPage) NextOffset() int {
+	if p.Offset+p.Limit >= p.Total {
+		return -1
+	}
+	return p.Offset + p.Limit
+}
+
+// handleListCards pages through the whole deck, or the cards tagged ?tag=,
+// ?limit= cards (default 50, at most maxCardsPage) from ?offset=, in a
+// cardSorts order picked by ?sort= (default freq). It renders a table, or JSON with the deck total
+// for ?format=json.
+func (app *application) handleListCards(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page := cardsPage{Limit: 50, Sort: cmp.Or(q.Get("sort"), "freq")}
+	if _, ok := cardSorts[page.Sort]; !ok {
+		app.renderError(w, http.StatusBadRequest, "sort must be freq, headword, due, difficulty, stability or lapses.")
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCardsPage {
+			app.renderError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d.", maxCardsPage))
+			return
+		}
+		page.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			app.renderError(w, http.StatusBadRequest, "offset must be a non-negative integer.")
+			return
+		}
+		page.Offset = n
+	}
+	tag, err := parseTag(q.Get("tag"))
+	if err != nil {
+		app.renderError(w, http.StatusBadRequest, "tag "+err.Error()+".")
+		return
+	}
+	page.Tag = tag
+	cards, total, err := app.readCards.List(r.Context(), page.Sort, page.Tag, page.Limit, page.Offset)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	page.Cards, page.Total = cards, total
+	if q.Get("format") == "json" {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	if err := app.render(w, r, "cards.html", page); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// searchPage is the data for search.html.
+type searchPage struct {
+	Query string
+	// Definitions is set for full-text search over the definitions
+	// (?in=definitions) instead of headword and pinyin.
+	Definitions bool
+	Cards       []Card
+}
+
+// handleSearch looks cards up by ?q= against headword and pinyin, or with
+// ?in=definitions by full-text search over the definitions, listing up to
+// 50 with their schedule, or as JSON with ?format=json.
+func (app *application) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	page := searchPage{Query: strings.TrimSpace(r.URL.Query().Get("q")), Cards: []Card{}}
+	switch r.URL.Query().Get("in") {
+	case "", "headword":
+	case "definitions":
+		page.Definitions = true
+	default:
+		app.renderError(w, http.StatusBadRequest, "in must be headword or definitions.")
+		return
+	}
+	if page.Query != "" {
+		search := app.readCards.Search
+		if page.Definitions {
+			search = app.readCards.SearchDefinitions
+		}
+		cards, err := search(r.Context(), page.Query, 50)
+		if err != nil {
+			app.dbError(w, r, err)
+			return
+		}
+		page.Cards = cards
+	}
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, page.Cards)
+		return
+	}
+	if err := app.render(w, r, "search.html", page); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// handleLeeches lists the cards that crossed the leech threshold, as a
+// table or with ?format=json.
+func (app *application) handleLeeches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	cards, err := app.readCards.Leeches(r.Context())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, cards)
+		return
+	}
+	if err := app.render(w, r, "leeches.html", cards); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// handleHardest lists the ?n= (default 25, at most 100) cards with the
+// most lapses and highest difficulty, as a table or with ?format=json.
+func (app *application) handleHardest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	n := 25
+	if v := r.URL.Query().Get("n"); v != "" {
+		k, err := strconv.Atoi(v)
+		if err != nil || k < 1 || k > 100 {
+			app.renderError(w, http.StatusBadRequest, "n must be between 1 and 100.")
+			return
+		}
+		n = k
+	}
+	cards, err := app.readCards.Hardest(r.Context(), n)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, cards)
+		return
+	}
+	if err := app.render(w, r, "hardest.html", cards); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// handleForecast shows upcoming workload per day for ?days= (default 14,
+// at most 90), as a bar chart or with ?format=json.
+func (app *application) handleForecast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	days := 14
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			app.renderError(w, http.StatusBadRequest, "days must be a positive number.")
+			return
+		}
+		days = min(n, 90)
+	}
+	forecast, err := getForecast(r.Context(), app.readDB, days, app.timezone, app.clock.Now())
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, forecast)
+		return
+	}
+	if err := app.render(w, r, "forecast.html", forecast); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// handleHeatmap returns reviews per day over the last ?days= (default
+// 365, at most 730) as a dense JSON series for an activity heatmap.
+func (app *application) handleHeatmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	days := 365
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 730 {
+			writeJSONError(w, http.StatusBadRequest, "days must be between 1 and 730")
+			return
+		}
+		days = n
+	}
+	heatmap, err := getHeatmap(r.Context(), app.readDB, days, app.timezone, app.clock.Now())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, heatmap)
+}
+
+// handlePatterns shows when reviews happen, by hour of the day and day of
+// the week in the IANA zone ?tz= (default APP_TIMEZONE), as bar charts or,
+// with ?format=json, as JSON.
+func (app *application) handlePatterns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		app.methodNotAllowed(w)
+		return
+	}
+	loc := app.timezone
+	if v := r.URL.Query().Get("tz"); v != "" {
+		var err error
+		if loc, err = loadTimezone(v); err != nil {
+			app.renderError(w, http.StatusBadRequest, "tz must be an IANA time zone name, like Asia/Shanghai.")
+			return
+		}
+	}
+	patterns, err := getReviewPatterns(r.Context(), app.readDB, loc)
+	if err != nil {
+		app.dbError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, patterns)
+		return
+	}
+	if err := app.render(w, r, "patterns.html", patterns); err != nil {
+		app.templateError(w, r, err)
+	}
+}
+
+// handleStreak reports the current and longest runs of consecutive days
+// with at least one review. Days are counted in the IANA zone ?tz=
+// (default APP_TIMEZONE), so a review at 23:30 local time counts for that
+// day.
+func (app *application) handleStreak(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	loc := app.timezone
+	if v := r.URL.Query().Get("tz"); v != "" {
+		var err error
+		if loc, err = loadTimezone(v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "tz must be an IANA time zone name")
+			return
+		}
+	}
+	days, err := reviewDays(r.Context(), app.readDB, loc)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	y, m, d := app.clock.Now().In(loc).Date()
+	current, longest := streaks(days, time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+	var last *string
+	if len(days) > 0 {
+		s := days[len(days)-1].Format(time.DateOnly)
+		last = &s
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"current":          current,
+		"longest":          longest,
+		"last_review_date": last,
+		"tz":               loc.String(),
+	})
+}
+
+// handleCreateCard adds a card from form fields headword, pinyin,
+// english_definition, chinese_definition and optional freq, hsk_level,
+// desired_retention, example_sentence_zh and example_sentence_en. The card
+// enters the review queue as New straight away.
+func (app *application) handleCreateCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	c := Card{
+		Headword:  strings.TrimSpace(r.FormValue("headword")),
+		Pinyin:    strings.TrimSpace(r.FormValue("pinyin")),
+		EnDef:     strings.TrimSpace(r.FormValue("english_definition")),
+		ZhDef:     strings.TrimSpace(r.FormValue("chinese_definition")),
+		ExampleZh: strings.TrimSpace(r.FormValue("example_sentence_zh")),
+		ExampleEn: strings.TrimSpace(r.FormValue("example_sentence_en")),
+	}
+	if c.Headword == "" {
+		writeJSONError(w, http.StatusBadRequest, "headword is required")
+		return
+	}
+	if c.EnDef == "" && c.ZhDef == "" {
+		writeJSONError(w, http.StatusBadRequest, "at least one definition is required")
+		return
+	}
+	if v := r.FormValue("freq"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "freq must be a non-negative integer")
+			return
+		}
+		c.Freq = n
+	}
+	hsk, err := parseHSKLevel(r.FormValue("hsk_level"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "hsk_level must be a level from 1 to 9")
+		return
+	}
+	c.HSK = hsk
+	if c.DesiredRetention, err = parseRetention(r.FormValue("desired_retention")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "desired_retention must be between 0 and 1 exclusive")
+		return
+	}
+	if err := app.cards.Create(r.Context(), c, app.clock.Now()); err != nil {
+		if errors.Is(err, errCardExists) {
+			writeJSONError(w, http.StatusConflict, "card already exists (it may be in the trash)")
+			return
+		}
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	app.queueChanged()
+	card, err := app.cards.Load(r.Context(), c.Headword, "")
+	if err != nil || card == nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, card)
+}
+
+// handleEditCard updates pinyin, english_definition, chinese_definition,
+// freq, hsk_level, desired_retention and the example sentences for the
+// card named by the headword form field. Fields left out of the form keep
+// their current values; an empty hsk_level or desired_retention clears it.
+func (app *application) handleEditCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "form parse error")
+		return
+	}
+	card, err := app.cards.Load(r.Context(), r.FormValue("headword"), "")
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	if r.Form.Has("pinyin") {
+		card.Pinyin = strings.TrimSpace(r.FormValue("pinyin"))
+	}
+	if r.Form.Has("english_definition") {
+		card.EnDef = strings.TrimSpace(r.FormValue("english_definition"))
+	}
+	if r.Form.Has("chinese_definition") {
+		card.ZhDef = strings.TrimSpace(r.FormValue("chinese_definition"))
+	}
+	if r.Form.Has("example_sentence_zh") {
+		card.ExampleZh = strings.TrimSpace(r.FormValue("example_sentence_zh"))
+	}
+	if r.Form.Has("example_sentence_en") {
+		card.ExampleEn = strings.TrimSpace(r.FormValue("example_sentence_en"))
+	}
+	if r.Form.Has("freq") {
+		n, err := strconv.Atoi(r.FormValue("freq"))
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "freq must be a non-negative integer")
+			return
+		}
+		card.Freq = n
+	}
+	if r.Form.Has("hsk_level") {
+		hsk, err := parseHSKLevel(r.FormValue("hsk_level"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "hsk_level must be a level from 1 to 9")
+			return
+		}
+		card.HSK = hsk
+	}
+	if r.Form.Has("desired_retention") {
+		if card.DesiredRetention, err = parseRetention(r.FormValue("desired_retention")); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "desired_retention must be between 0 and 1 exclusive")
+			return
+		}
+	}
+	if card.EnDef == "" && card.ZhDef == "" {
+		writeJSONError(w, http.StatusBadRequest, "at least one definition is required")
+		return
+	}
+	if err := app.cards.UpdateContent(r.Context(), *card); err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	// The HSK level decides which filtered queues the card is in.
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, card)
+}
+
+// maxImportBytes caps a CSV upload.
+const maxImportBytes = 32 << 20
+
+// handleImport adds cards from a multipart CSV upload in the file field,
+// with columns headword,pinyin,english_definition,chinese_definition,freq.
+// on_duplicate=update overwrites the content of existing headwords;
+// the default, skip, leaves them alone. Uploads beyond 1MB are spooled to
+// disk by ParseMultipartForm rather than held in memory.
+func (app *application) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "expected a multipart upload of at most 32MB")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	var update bool
+	switch r.FormValue("on_duplicate") {
+	case "", "skip":
+	case "update":
+		update = true
+	default:
+		writeJSONError(w, http.StatusBadRequest, "on_duplicate must be skip or update")
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	defer f.Close()
+	rep, err := app.cards.Import(r.Context(), f, update, app.clock.Now())
+	if errors.Is(err, errBadCSV) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		jsonDBError(w, r, "import failed", err)
+		return
+	}
+	if rep.Inserted > 0 {
+		app.queueChanged()
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// handleExport streams the whole deck, schedules included, as a JSON
+// array of exportedCard that /import/json restores. The status is sent
+// before the first card, so a failure part way is logged and leaves the
+// array unterminated rather than producing a valid-looking short dump.
+func (app *application) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="anamnesis-deck.json"`)
+	enc := json.NewEncoder(w)
+	sep := "["
+	err := app.readCards.Export(r.Context(), func(c exportedCard) error {
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		sep = ","
+		return enc.Encode(c)
+	})
+	if err != nil {
+		if sep == "[" {
+			w.Header().Del("Content-Disposition")
+			jsonDBError(w, r, "export failed", err)
+			return
+		}
+		slog.ErrorContext(r.Context(), "export aborted", dbLogAttrs(r, err)...)
+		return
+	}
+	if sep == "[" {
+		io.WriteString(w, sep)
+	}
+	io.WriteString(w, "]\n")
+}
+
+// ankiHeader tells Anki's text importer (2.1.55+) how to read the
+// /export/anki file: comma separated, HTML fields, Basic notes, and tags in
+// the third column.
+const ankiHeader = `#separator:Comma
+#html:true
+#notetype:Basic
+#deck:Anamnesis
+#columns:Front,Back,Tags
+#tags column:3
+`
+
+// ankiLineBreaks turns line breaks into <br> for Anki's HTML fields.
+var ankiLineBreaks = strings.NewReplacer("\r\n", "<br>", "\n", "<br>")
+
+// ankiField escapes the non-empty parts for an HTML field, one per line.
+// CSV quoting of commas, quotes and newlines is left to csv.Writer.
+func ankiField(parts ...string) string {
+	var kept []string
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			kept = append(kept, ankiLineBreaks.Replace(template.HTMLEscapeString(p)))
+		}
+	}
+	return strings.Join(kept, "<br>")
+}
+
+// handleExportAnki streams the deck as a CSV for Anki's Basic note type:
+// headword and pinyin on the front, definitions and the example sentence
+// on the back, and the HSK level as a tag. Scheduling is not carried
+// over; Anki starts the cards as new.
+func (app *application) handleExportAnki(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="anamnesis-anki.csv"`)
+	io.WriteString(w, ankiHeader)
+	cw := csv.NewWriter(w)
+	err := app.readCards.Export(r.Context(), func(c exportedCard) error {
+		tags := "anamnesis"
+		if c.HSK != nil {
+			tags += " hsk" + strconv.Itoa(*c.HSK)
+		}
+		var example []string
+		if c.ExampleZh != nil {
+			example = append(example, *c.ExampleZh)
+		}
+		if c.ExampleEn != nil {
+			example = append(example, *c.ExampleEn)
+		}
+		return cw.Write([]string{
+			ankiField(c.Headword, c.Pinyin),
+			ankiField(append([]string{c.EnDef, c.ZhDef}, example...)...),
+			tags,
+		})
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		// The header is already out, so all that is left is to log.
+		slog.ErrorContext(r.Context(), "anki export aborted", dbLogAttrs(r, err)...)
+	}
+}
+
+// handleImportJSON restores a dump written by /export from the request
+// body, upserting each card by headword with its schedule unchanged. It
+// also takes cards from another SRS: only headword is required, and any
+// of stability, difficulty, state, last_review, due_at, lapses and
+// reps_ct given are kept as they are; see restoreDeck.
+func (app *application) handleImportJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	rep, err := app.cards.Restore(r.Context(), r.Body, app.clock.Now())
+	if errors.Is(err, errBadDump) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		jsonDBError(w, r, "import failed", err)
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// handleDeleteCard moves the card named by the headword form field to the
+// trash (see deleteCard); /cards/restore brings it back.
+func (app *application) handleDeleteCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	headword := r.FormValue("headword")
+	ok, err := app.cards.Delete(r.Context(), headword)
+	if err != nil {
+		jsonDBError(w, r, "delete failed", err)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{"headword": headword, "deleted": true})
+}
+
+// handleRestoreCard takes the card named by the headword form field out
+// of the trash, with its schedule as it was.
+func (app *application) handleRestoreCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	headword := r.FormValue("headword")
+	ok, err := app.cards.Undelete(r.Context(), headword)
+	if err != nil {
+		jsonDBError(w, r, "restore failed", err)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "card not in trash")
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{"headword": headword, "deleted": false})
+}
+
+// handleTrash lists the deleted cards, most recent first.
+func (app *application) handleTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	cards, err := app.readCards.Trash(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"cards": cards})
+}
+
+// handleSuspendCard toggles whether the card named by the headword form
+// field is kept out of the review queue.
+func (app *application) handleSuspendCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	headword := r.FormValue("headword")
+	suspended, ok, err := app.cards.ToggleSuspended(r.Context(), headword)
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{"headword": headword, "suspended": suspended})
+}
+
+// resetSchedule clears c's schedule to that of a card created at now: New,
+// with no stability, difficulty or history, and due straight away. The
+// next grade then takes FSRS's first-review path, as for a new card.
+func resetSchedule(c *Card, now time.Time) {
+	c.Stability = 0
+	c.Difficulty = 0
+	c.Lapses = 0
+	c.Reps = 0
+	c.State = int(fsrs.New)
+	c.LastReview = now
+	c.Due = now
+}
+
+// resetCard starts one aspect of a card over as new. It returns nil, nil
+// when there is no such card. The review log is kept.
+func (app *application) resetCard(ctx context.Context, headword, aspect string, now time.Time) (*Card, error) {
+	var c *Card
+	err := app.cards.InTx(ctx, func(repo CardRepository) error {
+		var err error
+		c, err = repo.Lock(ctx, headword, aspect)
+		if err != nil || c == nil {
+			return err
+		}
+		resetSchedule(c, now)
+		return repo.SaveSchedule(ctx, c)
+	})
+	if err != nil || c == nil {
+		return nil, err
+	}
+	app.queueChanged()
+	return c, nil
+}
+
+// handleResetCard starts the card named by the headword form field over as
+// a new card, for when a run of misgrades has left its schedule beyond
+// repair by /undo. The optional aspect field picks an aspect other than
+// recognition.
+func (app *application) handleResetCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	card, err := app.resetCard(r.Context(), r.FormValue("headword"), r.FormValue("aspect"), app.clock.Now())
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, card)
+}
+
+// maxDueOffsetDays bounds the days field of /cards/due either way.
+const maxDueOffsetDays = 36500
+
+// errDueInPast rejects a manual due date that would bury a card as
+// long overdue.
+var errDueInPast = errors.New("due date is more than a day in the past")
+
+// setCardDue moves one aspect of a card to due, leaving the rest of its
+// schedule alone, or with shift moves it by days from its current due
+// date. It returns nil, nil when there is no such card, and
+// errDueInPast when the resulting date is more than a day ago.
+func (app *application) setCardDue(ctx context.Context, headword, aspect string, due time.Time, shift int, now time.Time) (*Card, error) {
+	var c *Card
+	err := app.cards.InTx(ctx, func(repo CardRepository) error {
+		var err error
+		c, err = repo.Lock(ctx, headword, aspect)
+		if err != nil || c == nil {
+			return err
+		}
+		if due.IsZero() {
+			due = c.Due.AddDate(0, 0, shift)
+		}
+		if due.Before(now.Add(-24 * time.Hour)) {
+			return errDueInPast
+		}
+		c.Due = due
+		return repo.SaveSchedule(ctx, c)
+	})
+	if err != nil || c == nil {
+		return nil, err
+	}
+	app.queueChanged()
+	return c, nil
+}
+
+// handleSetDue overrides the due date of the card named by the headword
+// form field without grading it: due sets it outright (RFC 3339, or a
+// YYYY-MM-DD date meaning midnight), days moves it that many days from
+// its current due date. Only due_at changes. The optional aspect field
+// picks an aspect other than recognition.
+func (app *application) handleSetDue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	now := app.clock.Now()
+	var (
+		due   time.Time
+		shift int
+		err   error
+	)
+	switch v, d := r.FormValue("due"), r.FormValue("days"); {
+	case v != "" && d != "":
+		writeJSONError(w, http.StatusBadRequest, "give either due or days, not both")
+		return
+	case v != "":
+		if due, err = time.Parse(time.RFC3339, v); err != nil {
+			due, err = time.ParseInLocation(time.DateOnly, v, now.Location())
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "due must be an RFC 3339 time or a YYYY-MM-DD date")
+			return
+		}
+	case d != "":
+		shift, err = strconv.Atoi(d)
+		if err != nil || shift < -maxDueOffsetDays || shift > maxDueOffsetDays {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("days must be an integer between -%d and %d", maxDueOffsetDays, maxDueOffsetDays))
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, "due or days is required")
+		return
+	}
+	if !due.IsZero() && due.After(now.AddDate(0, 0, maxDueOffsetDays)) {
+		writeJSONError(w, http.StatusBadRequest, "due is too far in the future")
+		return
+	}
+	card, err := app.setCardDue(r.Context(), r.FormValue("headword"), r.FormValue("aspect"), due, shift, now)
+	if errors.Is(err, errDueInPast) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, card)
+}
+
+// tagsForm reads the repeatable tag form field, normalized by parseTag.
+func tagsForm(r *http.Request) ([]string, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, v := range r.Form["tag"] {
+		t, err := parseTag(v)
+		if err != nil {
+			return nil, fmt.Errorf("tag %s", err)
+		}
+		if t != "" {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) == 0 {
+		return nil, errors.New("tag is required")
+	}
+	return tags, nil
+}
+
+// handleTagCard adds the tag form fields (one or more) to the card named
+// by the headword form field; handleUntagCard removes them.
+func (app *application) handleTagCard(w http.ResponseWriter, r *http.Request) {
+	app.changeTags(w, r, app.cards.AddTags)
+}
+
+func (app *application) handleUntagCard(w http.ResponseWriter, r *http.Request) {
+	app.changeTags(w, r, app.cards.RemoveTags)
+}
+
+func (app *application) changeTags(w http.ResponseWriter, r *http.Request, change func(context.Context, string, []string) ([]string, bool, error)) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	tags, err := tagsForm(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	headword := r.FormValue("headword")
+	out, ok, err := change(r.Context(), headword, tags)
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{"headword": headword, "tags": out})
+}
+
+// handleTags lists the tags in use with their card and due counts, most
+// used first. It serves both /tags and /api/tags.
+func (app *application) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	tags, err := getTags(r.Context(), app.readDB, app.clock.Now())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// errUnscheduled is recomputeDue's refusal of a card with no schedule to
+// recompute from.
+var errUnscheduled = errors.New("card has no stability or last_review to schedule from")
+
+// recomputeDue resets due_at of the card's aspect from its stored
+// stability and last_review through dueFromStability, inside one
+// transaction on repo, and returns the card as saved with the interval
+// used, in days. It returns nil when there is no such card.
+func recomputeDue(ctx context.Context, repo CardRepository, s *scheduling, headword, aspect string) (*Card, float64, error) {
+	var (
+		card *Card
+		ivl  float64
+	)
+	err := repo.InTx(ctx, func(repo CardRepository) error {
+		c, err := repo.Lock(ctx, headword, aspect)
+		if err != nil || c == nil {
+			return err
+		}
+		if c.State == int(fsrs.New) || c.Stability <= 0 || c.LastReview.IsZero() {
+			return errUnscheduled
+		}
+		s.dueFromStability(c)
+		ivl = c.Due.Sub(c.LastReview).Hours() / 24
+		if err := repo.SaveSchedule(ctx, c); err != nil {
+			return err
+		}
+		card = c
+		return nil
+	})
+	return card, ivl, err
+}
+
+// rebuildResult is one aspect of a card before and after rebuildCards
+// replayed its reviews onto it.
+type rebuildResult struct {
+	Headword string `json:"headword"`
+	Aspect   string `json:"aspect"`
+	Reviews  int    `json:"reviews"`
+	Before   Card   `json:"before"`
+	After    Card   `json:"after"`
+}
+
+// rebuildCards overwrites the schedule of every logged aspect of headword,
+// or of every logged card when headword is "", with the one its review
+// log replays to, in one transaction on repo. Cards with no logged
+// reviews, and logs of cards since deleted, are left alone, as are cards
+// stored New with no reps: resets aren't logged, so that is a card reset
+// since its last logged review, and replaying would undo the reset. Once
+// it is graded again, that review was logged from New and replays fresh.
+func rebuildCards(ctx context.Context, repo CardRepository, s *scheduling, headword string) ([]rebuildResult, error) {
+	results := []rebuildResult{}
+	err := repo.InTx(ctx, func(repo CardRepository) error {
+		logged, err := repo.ReviewLog(ctx, headword)
+		if err != nil {
+			return err
+		}
+		for _, lc := range logged {
+			c, err := repo.Lock(ctx, lc.headword, lc.aspect)
+			if err != nil {
+				return err
+			}
+			if c == nil || c.State == int(fsrs.New) && c.Reps == 0 {
+				continue
+			}
+			res := rebuildResult{Headword: c.Headword, Aspect: lc.aspect, Reviews: len(lc.reviews), Before: *c}
+			s.replayReviews(c, lc.reviews)
+			if err := repo.SaveSchedule(ctx, c); err != nil {
+				return err
+			}
+			res.After = *c
+			results = append(results, res)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// handleRebuild re-derives FSRS state from the review log: POST
+// /api/cards/{headword}/rebuild for each aspect of one card, POST
+// /api/rebuild for the whole deck. It answers each card's schedule
+// before and after.
+func (app *application) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	headword := r.PathValue("headword")
+	if headword != "" {
+		card, err := app.cards.Load(r.Context(), headword, "")
+		if err != nil {
+			jsonDBError(w, r, "db error", err)
+			return
+		}
+		if card == nil {
+			writeJSONError(w, http.StatusNotFound, "card not found")
+			return
+		}
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	results, err := rebuildCards(r.Context(), app.cards, sched, headword)
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{"rebuilt": results})
+}
+
+// handleRecomputeDue resets due_at from the card's stored stability and
+// last_review without grading it, for repairing cards after manual edits.
+// ?aspect= picks the aspect; the default is recognition.
+func (app *application) handleRecomputeDue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	card, ivl, err := recomputeDue(r.Context(), app.cards, sched, r.PathValue("headword"), r.URL.Query().Get("aspect"))
+	if errors.Is(err, errUnscheduled) {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"headword":      card.Headword,
+		"aspect":        cmp.Or(card.Aspect, aspectRecognition),
+		"due_at":        card.Due,
+		"interval_days": ivl,
+	})
+}
+
+// handleInfo is the client bootstrap call: deck size, due count and the
+// scheduler settings in one cheap aggregate.
+func (app *application) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	info, err := getDeckInfo(r.Context(), app.db, app.clock.Now())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	p := sched.fsrs.Parameters
+	writeJSON(w, http.StatusOK, map[string]any{
+		"initialized":     info.Total > 0,
+		"total":           info.Total,
+		"due":             info.Due,
+		"earliest_due_at": info.EarliestDueAt,
+		"latest_due_at":   info.LatestDueAt,
+		"params": map[string]any{
+			"desired_retention": p.RequestRetention,
+			"maximum_interval":  p.MaximumInterval,
+			"short_term":        p.EnableShortTerm,
+		},
+	})
+}
+
+// handleGetCard returns one card's content and full FSRS state as JSON,
+// like /api/next serves it, with the same ETag. It reads the primary so a
+// client sees its own edits and grades at once. ?aspect= picks an aspect
+// other than recognition.
+func (app *application) handleGetCard(w http.ResponseWriter, r *http.Request) {
+	card, err := app.cards.Load(r.Context(), r.PathValue("headword"), r.URL.Query().Get("aspect"))
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	setLastModified(w, *card)
+	if notModified(w, r, cardsETag(*card)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPICard(*card, app.clock.Now()))
+}
+
+// handleNeighbors returns the cards ranked immediately above (more
+// frequent) and below (less frequent) the given headword. Near either end
+// of the list one side is simply shorter.
+func (app *application) handleNeighbors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	window := 5
+	if v := r.URL.Query().Get("window"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 50 {
+			writeJSONError(w, http.StatusBadRequest, "window must be between 1 and 50")
+			return
+		}
+		window = n
+	}
+	card, err := app.cards.Load(r.Context(), r.PathValue("headword"), "")
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	neighbors, err := getFreqNeighbors(r.Context(), app.db, card.Headword, window)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	above, below := []Card{}, []Card{}
+	for _, n := range neighbors {
+		if n.Freq > card.Freq || (n.Freq == card.Freq && n.Headword < card.Headword) {
+			above = append(above, n)
+		} else {
+			below = append(below, n)
+		}
+	}
+	all := append([]Card{*card}, neighbors...)
+	setLastModified(w, all...)
+	if notModified(w, r, cardsETag(all...)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"card":  card,
+		"above": above,
+		"below": below,
+	})
+}
+
+// handleRepair runs repairCardStates on demand. ?dry_run=1 reports what
+// would change without writing.
+func (app *application) handleRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	report, err := repairCardStates(r.Context(), app.db, dryRun)
+	if err != nil {
+		jsonDBError(w, r, "repair failed", err)
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"dry_run": dryRun,
+		"changed": report,
+	})
+}
+
+// handleVacation reports whether vacation mode is on.
+func (app *application) handleVacation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var v vacation
+	ok, err := getSetting(r.Context(), app.db, vacationKey, &v)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"active": true, "start": v.Start, "until": v.Until})
+}
+
+// handleVacationStart turns vacation mode on, with an optional
+// {"until": ...} body recording the planned return.
+func (app *application) handleVacationStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body struct {
+		Until *time.Time `json:"until"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+	var v vacation
+	ok, err := getSetting(r.Context(), app.db, vacationKey, &v)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if ok {
+		writeJSONError(w, http.StatusConflict, "vacation mode already active")
+		return
+	}
+	v = vacation{Start: app.clock.Now(), Until: body.Until}
+	if body.Until != nil && !body.Until.After(v.Start) {
+		writeJSONError(w, http.StatusBadRequest, "until must be in the future")
+		return
+	}
+	if err := putSetting(r.Context(), app.db, vacationKey, v); err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"active": true, "start": v.Start, "until": v.Until})
+}
+
+// handleVacationEnd turns vacation mode off and shifts the schedule by the
+// time spent away; see endVacation.
+func (app *application) handleVacationEnd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var v vacation
+	ok, err := getSetting(r.Context(), app.db, vacationKey, &v)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusConflict, "vacation mode not active")
+		return
+	}
+	// One now for both, so away_hours is exactly the shift applied.
+	now := app.clock.Now()
+	shifted, err := endVacation(r.Context(), app.db, v, now)
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"active":     false,
+		"away_hours": now.Sub(v.Start).Hours(),
+		"shifted":    shifted,
+	})
+}
+
+// handleCardHistory returns a card's past reviews as JSON, oldest first:
+// reviewed_at, rating, the interval_days each one set and the stability
+// it resulted in, the series a card's growth chart plots. A card never
+// reviewed has an empty history. ?aspect= picks an aspect other than
+// recognition. It serves both /cards/{headword}/history and
+// /api/cards/{headword}/intervals.
+func (app *application) handleCardHistory(w http.ResponseWriter, r *http.Request) {
+	card, err := app.readCards.Load(r.Context(), r.PathValue("headword"), r.URL.Query().Get("aspect"))
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	if card == nil {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	history, err := getCardHistory(r.Context(), app.readDB, card.Headword, card.Aspect)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"headword": card.Headword,
+		"aspect":   cmp.Or(card.Aspect, aspectRecognition),
+		"history":  history,
+	})
+}
+
+// handleRevealStats reports how often answers are revealed and then
+// abandoned without a grade, over ?days= (default 30).
+func (app *application) handleRevealStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			writeJSONError(w, http.StatusBadRequest, "days must be between 1 and 365")
+			return
+		}
+		days = n
+	}
+	st, err := getRevealStats(r.Context(), app.readDB, days, app.clock.Now())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// handleRetention reports true retention, the share of reviews over ?days=
+// (default 30) graded Good or Easy, next to the desired retention.
+// ?exclude_new=true leaves out first reviews of new cards.
+func (app *application) handleRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			writeJSONError(w, http.StatusBadRequest, "days must be between 1 and 365")
+			return
+		}
+		days = n
+	}
+	excludeNew := false
+	if v := r.URL.Query().Get("exclude_new"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "exclude_new must be true or false")
+			return
+		}
+		excludeNew = b
+	}
+	st, err := getRetention(r.Context(), app.readDB, days, excludeNew, app.clock.Now())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	st.Desired = sched.fsrs.Parameters.RequestRetention
+	writeJSON(w, http.StatusOK, st)
+}
+
+// handleSetNewOrder sets or clears ({"new_order": null}) one card's
+// position in the new-card queue.
+func (app *application) handleSetNewOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body struct {
+		NewOrder *int `json:"new_order"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	tag, err := app.db.Exec(r.Context(), `update entries set new_order = $1 where user_id = $2 and headword = $3 and deleted_at is null`, body.NewOrder, userID(r.Context()), r.PathValue("headword"))
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeJSONError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{"headword": r.PathValue("headword"), "new_order": body.NewOrder})
+}
+
+// handleBulkNewOrder curates the new-card queue from an ordered list:
+// {"headwords": [...], "replace": true}.
+func (app *application) handleBulkNewOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body struct {
+		Headwords []string `json:"headwords"`
+		Replace   bool     `json:"replace"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if len(body.Headwords) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "headwords is empty")
+		return
+	}
+	missing, err := setNewOrder(r.Context(), app.db, body.Headwords, body.Replace)
+	if err != nil {
+		jsonDBError(w, r, "save failed", err)
+		return
+	}
+	app.queueChanged()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ordered": len(body.Headwords) - len(missing),
+		"missing": missing,
+	})
+}
+
+// handleReschedule rewrites every reviewed card's due date under the
+// current FSRS parameters; see rescheduleCards. Run it after changing
+// FSRS_WEIGHTS or DESIRED_RETENTION; /api/params/impact previews it.
+func (app *application) handleReschedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	p := sched.fsrs.Parameters
+	examined, moved, err := rescheduleCards(r.Context(), app.db, sched)
+	// Earlier batches are committed even when a later one fails.
+	if moved > 0 {
+		app.queueChanged()
+	}
+	if err != nil {
+		jsonDBError(w, r, "reschedule failed", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"examined":          examined,
+		"rescheduled":       moved,
+		"desired_retention": p.RequestRetention,
+	})
+}
+
+// handleReload re-reads the configuration and swaps in new scheduling
+// settings without touching the pool: FSRS_WEIGHTS, DESIRED_RETENTION,
+// MIN_REPS_BEFORE_MATURE, IMMATURE_MAX_INTERVAL_DAYS, LEARN_AHEAD,
+// REVIEW_ORDER, GRADE_BUTTONS, LEECH_THRESHOLD and LEECH_SUSPEND. New
+// values come from ENV_FILE, which is read again first. Everything else
+// (database and pool settings, API keys, SESSION_SECRET, ASPECTS, time
+// zone, TTS) still needs a restart. Invalid config leaves the running
+// settings as they were. With no API key configured the endpoint is
+// refused, since anyone could call it.
+func (app *application) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if len(app.apiKeys) == 0 {
+		writeJSONError(w, http.StatusForbidden, "reload needs API_KEY to be set")
+		return
+	}
+	if err := loadEnvFile(os.Getenv("ENV_FILE")); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "ENV_FILE: "+err.Error())
+		return
+	}
+	cfg, err := loadDBConfigFromEnv()
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	s := newScheduling(cfg)
+	app.sched.Store(s)
+	// Cached next-due cards were timed for the old learn-ahead window.
+	app.queueChanged()
+	slog.Info("scheduling settings reloaded", "desired_retention", cfg.FSRS.RequestRetention, "review_order", s.reviewOrder, "learn_ahead", s.learnAhead)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"desired_retention":          cfg.FSRS.RequestRetention,
+		"weights":                    cfg.FSRS.W,
+		"min_reps_before_mature":     s.minRepsBeforeMature,
+		"immature_max_interval_days": cfg.ImmatureMaxIntervalDays,
+		"learn_ahead":                s.learnAhead.String(),
+		"review_order":               s.reviewOrder,
+		"grade_buttons":              s.gradeButtons,
+		"leech_threshold":            s.leechThreshold,
+		"leech_suspend":              s.leechSuspend,
+		"new_cards_per_day":          s.newPerDay,
+		"new_card_ramp_after_days":   s.rampAfter,
+		"new_card_ramp_days":         s.rampDays,
+	})
+}
+
+// optimizeJob is one run of POST /admin/optimize, as GET
+// /admin/optimize/{id} reports it.
+type optimizeJob struct {
+	ID       string          `json:"id"`
+	user     string          // only this user can see the job
+	Status   string          `json:"status"` // running, done or failed
+	Step     int             `json:"step"`
+	Steps    int             `json:"steps"`
+	Result   *optimizeResult `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Started  time.Time       `json:"started_at"`
+	Finished *time.Time      `json:"finished_at,omitempty"`
+}
+
+// optimizeJobKeep is how long a finished job stays pollable.
+const optimizeJobKeep = 24 * time.Hour
+
+// optimizeJobs holds optimize runs in memory, so they are lost on
+// restart and only visible on the instance that started them.
+type optimizeJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*optimizeJob
+}
+
+// start registers a running job for user, or returns ok=false if user
+// already has one running. Jobs finished over optimizeJobKeep ago are
+// dropped.
+func (s *optimizeJobs) start(user string, now time.Time) (job optimizeJob, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		if j.user == user && j.Status == "running" {
+			return optimizeJob{}, false
+		}
+		if j.Finished != nil && now.Sub(*j.Finished) > optimizeJobKeep {
+			delete(s.jobs, id)
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	j := &optimizeJob{ID: hex.EncodeToString(b), user: user, Status: "running", Steps: optimizeSteps, Started: now}
+	if s.jobs == nil {
+		s.jobs = map[string]*optimizeJob{}
+	}
+	s.jobs[j.ID] = j
+	return *j, true
+}
+
+// update applies fn to the job under the lock.
+func (s *optimizeJobs) update(id string, fn func(*optimizeJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		fn(j)
+	}
+}
+
+// get returns a copy of user's job id.
+func (s *optimizeJobs) get(user, id string) (optimizeJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.user != user {
+		return optimizeJob{}, false
+	}
+	return *j, true
+}
+
+// handleOptimize starts fitting the FSRS weights to the user's review
+// history (see optimizeWeights) and answers 202 with the job to poll at
+// GET /admin/optimize/{id}. Weights that beat the current ones are saved
+// to the user's user_params row, which their grades use from then on;
+// POST /admin/reschedule moves existing due dates to match. The job runs
+// in the background of this instance, so it needs the long-lived server
+// rather than the serverless deploy.
+func (app *application) handleOptimize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	p := sched.fsrs.Parameters
+	user := userID(r.Context())
+	job, ok := app.optimizeJobs.start(user, app.clock.Now())
+	if !ok {
+		writeJSONError(w, http.StatusConflict, "an optimize job is already running")
+		return
+	}
+	go app.runOptimize(withUserID(app.bg, user), job.ID, p)
+	w.Header().Set("Location", "/admin/optimize/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// runOptimize does the work of job id and records how it ended.
+func (app *application) runOptimize(ctx context.Context, id string, p fsrs.Parameters) {
+	history, err := getReviewHistory(ctx, app.readDB)
+	var res optimizeResult
+	if err == nil {
+		res, err = optimizeWeights(ctx, p, history, func(step int) {
+			app.optimizeJobs.update(id, func(j *optimizeJob) { j.Step = step })
+		})
+	}
+	if err == nil && res.LossAfter < res.LossBefore {
+		err = putUserParams(ctx, app.db, res.Weights, p.RequestRetention)
+		res.Saved = err == nil
+	}
+	now := app.clock.Now()
+	app.optimizeJobs.update(id, func(j *optimizeJob) {
+		j.Finished = &now
+		if err != nil {
+			j.Status, j.Error = "failed", err.Error()
+			return
+		}
+		j.Status, j.Result = "done", &res
+	})
+	if err != nil {
+		slog.Error("optimize failed", "job", id, "user", userID(ctx), "err", err)
+		return
+	}
+	slog.Info("optimize done", "job", id, "user", userID(ctx), "reviews", res.Reviews, "loss_before", res.LossBefore, "loss_after", res.LossAfter)
+}
+
+// handleOptimizeStatus reports an optimize job; see handleOptimize.
+func (app *application) handleOptimizeStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	job, ok := app.optimizeJobs.get(userID(r.Context()), r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no such optimize job")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// poolDebug is a snapshot of one pool for /admin/debug.
+type poolDebug struct {
+	DSN                     string `json:"dsn"`
+	MaxConns                int32  `json:"max_conns"`
+	TotalConns              int32  `json:"total_conns"`
+	AcquiredConns           int32  `json:"acquired_conns"`
+	IdleConns               int32  `json:"idle_conns"`
+	ConstructingConns       int32  `json:"constructing_conns"`
+	AcquireCount            int64  `json:"acquire_count"`
+	AcquireDuration         string `json:"acquire_duration"`
+	EmptyAcquireCount       int64  `json:"empty_acquire_count"`
+	EmptyAcquireWaitTime    string `json:"empty_acquire_wait_time"`
+	CanceledAcquireCount    int64  `json:"canceled_acquire_count"`
+	NewConnsCount           int64  `json:"new_conns_count"`
+	MaxLifetimeDestroyCount int64  `json:"max_lifetime_destroy_count"`
+	MaxIdleDestroyCount     int64  `json:"max_idle_destroy_count"`
+}
+
+func newPoolDebug(pool *pgxpool.Pool) poolDebug {
+	st := pool.Stat()
+	return poolDebug{
+		DSN:                     redactDSN(pool.Config().ConnString()),
+		MaxConns:                st.MaxConns(),
+		TotalConns:              st.TotalConns(),
+		AcquiredConns:           st.AcquiredConns(),
+		IdleConns:               st.IdleConns(),
+		ConstructingConns:       st.ConstructingConns(),
+		AcquireCount:            st.AcquireCount(),
+		AcquireDuration:         st.AcquireDuration().String(),
+		EmptyAcquireCount:       st.EmptyAcquireCount(),
+		EmptyAcquireWaitTime:    st.EmptyAcquireWaitTime().String(),
+		CanceledAcquireCount:    st.CanceledAcquireCount(),
+		NewConnsCount:           st.NewConnsCount(),
+		MaxLifetimeDestroyCount: st.MaxLifetimeDestroyCount(),
+		MaxIdleDestroyCount:     st.MaxIdleDestroyCount(),
+	}
+}
+
+// handleDebug dumps the pools' statistics and the startup settings (see
+// debugConfig), to see whether the pool is saturated. empty_acquire
+// counts acquires that had to wait for a connection. Like /admin/reload it
+// is refused when no API key is configured.
+func (app *application) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if len(app.apiKeys) == 0 {
+		writeJSONError(w, http.StatusForbidden, "debug needs API_KEY to be set")
+		return
+	}
+	pools := map[string]poolDebug{"primary": newPoolDebug(app.db)}
+	if app.readDB != app.db {
+		pools["replica"] = newPoolDebug(app.readDB)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"pools":  pools,
+		"config": app.config.debug(),
+	})
+}
+
+// handleParamImpact previews a parameter change: which cards' stored
+// due_at disagrees most with the current parameters. Read-only; ?limit=
+// defaults to 50.
+func (app *application) handleParamImpact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+	sched, err := app.schedFor(r.Context())
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	impacts, examined, err := getParamImpact(r.Context(), app.readDB, sched, limit)
+	if err != nil {
+		jsonDBError(w, r, "db error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"examined": examined,
+		"cards":    impacts,
+	})
+}
+
+var (
+	app   *application
+	appMu sync.Mutex
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationLockID is the advisory lock held while migrating, so two
+// instances starting at once don't both apply the same file.
+const migrationLockID = 0x616e616d // "anam"
+
+// migration is one forward-only file from migrations/, versioned by the
+// number its name starts with.
+type migration struct {
+	Version int
+	Name    string
+}
+
+// listMigrations returns the embedded migrations in version order.
+func listMigrations() ([]migration, error) {
+	names, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var out []migration
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		prefix, _, _ := strings.Cut(base, "_")
+		v, err := strconv.Atoi(prefix)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("migration %s: name must start with a version number", base)
+		}
+		if len(out) > 0 && out[len(out)-1].Version == v {
+			return nil, fmt.Errorf("migration %s: version %d is used twice", base, v)
+		}
+		out = append(out, migration{Version: v, Name: base})
+	}
+	slices.SortFunc(out, func(a, b migration) int { return cmp.Compare(a.Version, b.Version) })
+	return out, nil
+}
+
+// migrate applies every embedded migration not yet recorded in
+// schema_migrations, each in its own transaction together with its
+// record, and returns the names it applied. With baseline > 0 nothing
+// runs: versions up to baseline are only recorded, for a database whose
+// schema was brought up to date by hand before the runner existed (not
+// every early file is safe to apply twice).
+func migrate(ctx context.Context, pool *pgxpool.Pool, baseline int) ([]string, error) {
+	migrations, err := listMigrations()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `select pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// The lock is session-level, so release it even if ctx is done.
+		if _, err := conn.Exec(context.Background(), `select pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			slog.Error("migration unlock", "err", err)
+		}
+	}()
+	if _, err := conn.Exec(ctx, `
+		create table if not exists schema_migrations (
+		    version    integer     primary key,
+		    name       text        not null,
+		    applied_at timestamptz not null default now()
+		)`); err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `select version from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		done[v] = true
+	}
+	var applied []string
+	for _, m := range migrations {
+		if done[m.Version] || (baseline > 0 && m.Version > baseline) {
+			continue
+		}
+		if err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if baseline == 0 {
+				body, err := migrationsFS.ReadFile("migrations/" + m.Name + ".sql")
+				if err != nil {
+					return err
+				}
+				// No arguments, so pgx sends the file over the simple
+				// protocol, which allows several statements.
+				if _, err := tx.Exec(ctx, string(body)); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(ctx, `insert into schema_migrations (version, name) values ($1, $2)`, m.Version, m.Name)
+			return err
+		}); err != nil {
+			return applied, fmt.Errorf("%s: %w", m.Name, err)
+		}
+		applied = append(applied, m.Name)
+	}
+	return applied, nil
+}
+
+// parseTemplates builds one template set per page, each holding the shared
+// layout plus that page. Every page defines "content", so they can't share
+// a set: the last one parsed would win.
+func parseTemplates() (map[string]*template.Template, error) {
+	pages, err := fs.Glob(templatesFS, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	sets := make(map[string]*template.Template, len(pages))
+	for _, page := range pages {
+		name := path.Base(page)
+		if name == "layout.html" {
+			continue
+		}
+		t, err := template.New(name).Funcs(csrfFuncs("")).ParseFS(templatesFS, "templates/layout.html", page)
+		if err != nil {
+			return nil, err
+		}
+		sets[name] = t
+	}
+	return sets, nil
+}
+
+// csrfFuncs provides csrfField, which templates put in every POST form
+// to carry the token withCSRF checks.
+func csrfFuncs(tok string) template.FuncMap {
+	return template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(tok) + `">`)
+		},
+	}
+}
+
+// render executes the named page template for r. Output is buffered so a
+// template that fails halfway leaves w untouched for an error page.
+func (app *application) render(w io.Writer, r *http.Request, name string, data any) error {
+	t, ok := app.tmpl[name]
+	if !ok {
+		return fmt.Errorf("no template %q", name)
+	}
+	t, err := t.Clone()
+	if err != nil {
+		return err
+	}
+	t.Funcs(csrfFuncs(csrfToken(r.Context())))
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// errorPage is the data for error.html.
+type errorPage struct {
+	Title   string
+	Message string
+}
+
+// renderError shows error.html with status and a message meant for the
+// user. Callers log the underlying error themselves.
+func (app *application) renderError(w http.ResponseWriter, status int, msg string) {
+	var buf bytes.Buffer
+	t, ok := app.tmpl["error.html"]
+	if ok {
+		// Execute a copy: html/template can't Clone a template that has
+		// run, and render clones every page. Without a request there is
+		// no CSRF token, so the undo button on this page won't work.
+		var err error
+		t, err = t.Clone()
+		ok = err == nil
+	}
+	if !ok || t.ExecuteTemplate(&buf, "error.html", errorPage{Title: http.StatusText(status), Message: msg}) != nil {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// dbLogAttrs is the context logged with a failed query: the route and,
+// when the path or an already parsed form names one, the card.
+func dbLogAttrs(r *http.Request, err error) []any {
+	attrs := []any{"method", r.Method, "path", r.URL.Path, "err", err}
+	hw := r.PathValue("headword")
+	if hw == "" && r.Form != nil {
+		hw = r.Form.Get("headword")
+	}
+	if hw != "" {
+		attrs = append(attrs, "headword", hw)
+	}
+	return attrs
+}
+
+// jsonDBError logs err and answers a JSON client with msg and the status
+// dbStatus picks. msg doubles as the log message, so it names the
+// operation ("save failed", "delete failed").
+func jsonDBError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	slog.ErrorContext(r.Context(), msg, dbLogAttrs(r, err)...)
+	writeJSONError(w, dbStatus(err), msg)
+}
+
+// dbError logs err and shows the error page for a failed query.
+func (app *application) dbError(w http.ResponseWriter, r *http.Request, err error) {
+	slog.ErrorContext(r.Context(), "db error", dbLogAttrs(r, err)...)
+	status := dbStatus(err)
+	if status == http.StatusGatewayTimeout {
+		app.renderError(w, status, "The database is taking too long to answer. Try again in a moment.")
+		return
+	}
+	app.renderError(w, status, "Something went wrong loading your cards. Try again in a moment.")
+}
+
+// templateError logs a failed render and shows the error page.
+func (app *application) templateError(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Error("template error", "path", r.URL.Path, "err", err)
+	app.renderError(w, http.StatusInternalServerError, "This page could not be displayed.")
+}
+
+func (app *application) methodNotAllowed(w http.ResponseWriter) {
+	app.renderError(w, http.StatusMethodNotAllowed, "This page can't be opened that way. Use the links and buttons on the site.")
+}
+
+// handleNotFound catches every path no other route matches.
+func (app *application) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		http.Redirect(w, r, "/review", http.StatusSeeOther)
+		return
+	}
+	app.renderError(w, http.StatusNotFound, "There is no page at this address.")
+}
+
+// metrics are the Prometheus series served on /metrics. They live in
+// their own registry rather than the global one, so a retried initApp
+// can build a fresh set without duplicate registrations.
+type metrics struct {
+	registry     *prometheus.Registry
+	reviews      *prometheus.CounterVec
+	gradeSeconds prometheus.Histogram
+	querySeconds prometheus.Histogram
+	cardsDue     prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		reviews: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "anamnesis_reviews_total",
+			Help: "Cards graded, by rating.",
+		}, []string{"rating"}),
+		gradeSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "anamnesis_grade_duration_seconds",
+			Help:    "Time to grade one card, lock to commit.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		querySeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "anamnesis_db_query_duration_seconds",
+			Help:    "Duration of individual database queries.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}),
+		// cardsDue has no user label: /metrics is served without
+		// credentials, and user IDs are not for anyone who can reach it.
+		cardsDue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "anamnesis_cards_due",
+			Help: "Cards due now across all users, refreshed every minute.",
+		}),
 	}
+	m.registry.MustRegister(
+		m.reviews, m.gradeSeconds, m.querySeconds, m.cardsDue,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
 }
 
-func (app *application) handleGrade(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// registerPool exports pool.Stat(), mostly to spot connection saturation:
+// acquired near max, or empty acquires and wait time climbing.
+func (m *metrics) registerPool(pool *pgxpool.Pool, name string) {
+	labels := prometheus.Labels{"pool": name}
+	gauge := func(name, help string, f func(*pgxpool.Stat) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help, ConstLabels: labels}, func() float64 { return f(pool.Stat()) })
 	}
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Form parse error", http.StatusBadRequest)
+	counter := func(name, help string, f func(*pgxpool.Stat) float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help, ConstLabels: labels}, func() float64 { return f(pool.Stat()) })
+	}
+	m.registry.MustRegister(
+		gauge("anamnesis_db_pool_acquired_conns", "Connections currently in use.", func(s *pgxpool.Stat) float64 { return float64(s.AcquiredConns()) }),
+		gauge("anamnesis_db_pool_idle_conns", "Idle connections.", func(s *pgxpool.Stat) float64 { return float64(s.IdleConns()) }),
+		gauge("anamnesis_db_pool_total_conns", "Open connections.", func(s *pgxpool.Stat) float64 { return float64(s.TotalConns()) }),
+		gauge("anamnesis_db_pool_max_conns", "Pool size limit.", func(s *pgxpool.Stat) float64 { return float64(s.MaxConns()) }),
+		counter("anamnesis_db_pool_acquires_total", "Successful connection acquires.", func(s *pgxpool.Stat) float64 { return float64(s.AcquireCount()) }),
+		counter("anamnesis_db_pool_empty_acquires_total", "Acquires that had to wait for a connection.", func(s *pgxpool.Stat) float64 { return float64(s.EmptyAcquireCount()) }),
+		counter("anamnesis_db_pool_canceled_acquires_total", "Acquires canceled while waiting.", func(s *pgxpool.Stat) float64 { return float64(s.CanceledAcquireCount()) }),
+		counter("anamnesis_db_pool_acquire_wait_seconds_total", "Time spent acquiring connections.", func(s *pgxpool.Stat) float64 { return s.AcquireDuration().Seconds() }),
+	)
+}
+
+type queryStartKey struct{}
+
+// queryTimer is a pgx tracer feeding querySeconds.
+type queryTimer struct {
+	hist prometheus.Histogram
+}
+
+func (m *metrics) queryTracer() pgx.QueryTracer {
+	return queryTimer{hist: m.querySeconds}
+}
+
+func (t queryTimer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, time.Now())
+}
+
+func (t queryTimer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryEndData) {
+	if start, ok := ctx.Value(queryStartKey{}).(time.Time); ok {
+		t.hist.Observe(time.Since(start).Seconds())
+	}
+}
+
+// updateDueGauge refreshes the cards_due gauge every interval until ctx
+// ends. On a serverless instance it only runs while the instance is awake.
+func (app *application) updateDueGauge(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		qctx, cancel := context.WithTimeout(ctx, app.queryTimeout)
+		n, err := countDueTotal(qctx, app.db, app.aspects, app.clock.Now())
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("due gauge update failed", "err", err)
+			}
+		} else {
+			app.metrics.cardsDue.Set(float64(n))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// newLogger logs JSON for log collectors, or text when developing.
+func newLogger(cfg dbConfig) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	if cfg.DevMode {
+		return slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+}
+
+// initApp builds the application from the environment. It fails rather
+// than panics so the caller can report the outage and retry later.
+func initApp() (*application, error) {
+	if err := loadEnvFile(os.Getenv("ENV_FILE")); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	cfg, err := loadDBConfigFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	slog.SetDefault(newLogger(cfg))
+	kairosURL, err := buildPostgresURL(cfg, cfg.KairosDB)
+	if err != nil {
+		return nil, fmt.Errorf("db url: %w", err)
+	}
+	tmpl, err := parseTemplates()
+	if err != nil {
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+	m := newMetrics()
+	poolCfg, err := newPoolConfig(cfg, kairosURL, m)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("connecting to postgres", "dsn", redactDSN(kairosURL))
+	dbPool, err := connectPool(context.Background(), poolCfg, cfg.ConnectRetries)
+	if err != nil {
+		return nil, err
+	}
+	m.registerPool(dbPool, "primary")
+	// Without a replica, reads share the primary pool.
+	readPool := dbPool
+	if cfg.ReplicaHost != "" {
+		replica := cfg
+		replica.Host, replica.Port = cfg.ReplicaHost, cfg.ReplicaPort
+		replicaURL, err := buildPostgresURL(replica, cfg.KairosDB)
+		if err != nil {
+			dbPool.Close()
+			return nil, fmt.Errorf("replica db url: %w", err)
+		}
+		replicaCfg, err := newPoolConfig(cfg, replicaURL, m)
+		if err != nil {
+			dbPool.Close()
+			return nil, fmt.Errorf("replica %w", err)
+		}
+		slog.Debug("connecting to postgres replica", "dsn", redactDSN(replicaURL))
+		if readPool, err = connectPool(context.Background(), replicaCfg, cfg.ConnectRetries); err != nil {
+			dbPool.Close()
+			return nil, fmt.Errorf("replica: %w", err)
+		}
+		m.registerPool(readPool, "replica")
+	}
+	closePools := func() {
+		dbPool.Close()
+		if readPool != dbPool {
+			readPool.Close()
+		}
+	}
+	if cfg.MigrateOnStartup {
+		// Migrations can rewrite whole tables, so they get longer than
+		// the rest of startup.
+		mctx, mcancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		applied, err := migrate(mctx, dbPool, 0)
+		mcancel()
+		if err != nil {
+			closePools()
+			return nil, fmt.Errorf("migrate: %w", err)
+		}
+		for _, name := range applied {
+			slog.Info("applied migration", "name", name)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if cfg.RepairOnStartup {
+		report, err := repairCardStates(ctx, dbPool, false)
+		if err != nil {
+			closePools()
+			return nil, fmt.Errorf("state repair: %w", err)
+		}
+		for rule, headwords := range report {
+			slog.Info("repaired card state", "rule", rule, "count", len(headwords), "headwords", headwords)
+		}
+	}
+	if len(cfg.Aspects) > 0 {
+		if err := seedAspects(ctx, dbPool, cfg.Aspects); err != nil {
+			closePools()
+			return nil, fmt.Errorf("aspect seed: %w", err)
+		}
+	}
+
+	a := &application{
+		db:         dbPool,
+		readDB:     readPool,
+		metrics:    m,
+		cards:      pgxCardRepo{db: dbPool, aspects: cfg.Aspects},
+		readCards:  pgxCardRepo{db: readPool, aspects: cfg.Aspects},
+		tmpl:       tmpl,
+		aspects:    cfg.Aspects,
+		logReveals: cfg.LogReveals,
+
+		dueCount:     &dueCountCache{ttl: cfg.DueCountCacheTTL},
+		nextDueCache: &nextDueCache{ttl: cfg.NextDueCacheTTL},
+		optimizeJobs: &optimizeJobs{},
+		debounce:     &gradeDebounce{window: cfg.GradeDebounce},
+		queryTimeout: cfg.QueryTimeout,
+		tokenKey:     cfg.TokenSecret,
+		tokenTTL:     cfg.TokenTTL,
+		identify:     singleUser,
+		timezone:     cfg.Timezone,
+		clock:        realClock{},
+		config:       cfg,
+	}
+	a.sched.Store(newScheduling(cfg))
+	if cfg.UserHeader != "" {
+		a.identify = headerIdentity(cfg.UserHeader)
+	}
+	if cfg.TTSURL != "" {
+		a.tts = &ttsClient{url: cfg.TTSURL, key: cfg.TTSKey, client: &http.Client{Timeout: ttsTimeout}}
+	}
+	for _, k := range cfg.APIKeys {
+		a.apiKeys = append(a.apiKeys, []byte(k))
+	}
+	a.handler = a.routes()
+	a.bg, a.stop = context.WithCancel(context.Background())
+	go a.updateDueGauge(a.bg, time.Minute)
+	go a.debounce.sweepEvery(a.bg, a.clock, time.Minute)
+	return a, nil
+}
+
+// newPoolConfig parses dsn into a pool config with cfg's pool sizing,
+// statement handling and query tracing applied.
+func newPoolConfig(cfg dbConfig, dsn string, m *metrics) (*pgxpool.Config, error) {
+	poolCfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("db config: %w", redactError(err, cfg.Password))
+	}
+	if cfg.PoolMaxConns > 0 {
+		poolCfg.MaxConns = int32(cfg.PoolMaxConns)
+	}
+	if cfg.PoolMinConns > 0 {
+		poolCfg.MinConns = int32(cfg.PoolMinConns)
+	}
+	poolCfg.ConnConfig.DefaultQueryExecMode = cfg.QueryExecMode
+	if cfg.StatementCacheSize > 0 {
+		poolCfg.ConnConfig.StatementCacheCapacity = cfg.StatementCacheSize
+	}
+	if poolCfg.MinConns > poolCfg.MaxConns {
+		return nil, fmt.Errorf("db config: PGPOOL_MIN_CONNS %d exceeds the pool's max of %d", poolCfg.MinConns, poolCfg.MaxConns)
+	}
+	poolCfg.ConnConfig.Tracer = m.queryTracer()
+	if cfg.DevMode {
+		logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		poolCfg.ConnConfig.Tracer = multitracer.New(m.queryTracer(), newQueryTracer(logger))
+	}
+	return poolCfg, nil
+}
+
+// connectPool builds a pool and pings it, retrying up to attempts times
+// with exponential backoff. Managed Postgres that was idle can take a few
+// seconds to wake, and the first cold start shouldn't fail for that.
+func connectPool(ctx context.Context, poolCfg *pgxpool.Config, attempts int) (*pgxpool.Pool, error) {
+	backoff := 500 * time.Millisecond
+	var err error
+	for i := 1; ; i++ {
+		var pool *pgxpool.Pool
+		pool, err = pingPool(ctx, poolCfg)
+		if err == nil {
+			return pool, nil
+		}
+		err = redactError(err, poolCfg.ConnConfig.Password)
+		if i >= attempts {
+			break
+		}
+		slog.Warn("db connect failed, retrying", "attempt", i, "of", attempts, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, 8*time.Second)
+	}
+	return nil, fmt.Errorf("db connect after %d attempts: %w", attempts, err)
+}
+
+// pingPool makes one connection attempt. NewWithConfig connects lazily,
+// so a pool can build fine while Postgres is unreachable; the ping finds
+// out now.
+func pingPool(ctx context.Context, poolCfg *pgxpool.Config) (*pgxpool.Pool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// getApp returns the shared application, building it on first use. Unlike
+// sync.Once, a failed build isn't remembered: the next caller tries again,
+// so the function recovers by itself once the database is back.
+func getApp() (*application, error) {
+	appMu.Lock()
+	defer appMu.Unlock()
+	if app != nil {
+		return app, nil
+	}
+	a, err := initApp()
+	if err != nil {
+		return nil, err
+	}
+	app = a
+	return app, nil
+}
+
+// routes builds the mux shared by the serverless Handler and Main.
+func (app *application) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.handleNotFound)
+	mux.HandleFunc("/review", app.handleReview)
+	mux.HandleFunc("/reveal", app.handleReveal)
+	mux.HandleFunc("/grade", app.handleGrade)
+	mux.HandleFunc("/undo", app.handleUndo)
+	mux.HandleFunc("/cram", app.handleCram)
+	mux.HandleFunc("/stats", app.handleStats)
+	mux.HandleFunc("/forecast", app.handleForecast)
+	mux.HandleFunc("/heatmap", app.handleHeatmap)
+	mux.HandleFunc("/streak", app.handleStreak)
+	mux.HandleFunc("/patterns", app.handlePatterns)
+	mux.HandleFunc("/search", app.handleSearch)
+	mux.HandleFunc("/leeches", app.handleLeeches)
+	mux.HandleFunc("/hardest", app.handleHardest)
+	mux.HandleFunc("GET /cards", app.handleListCards)
+	mux.HandleFunc("/cards", app.handleCreateCard)
+	mux.HandleFunc("/cards/edit", app.handleEditCard)
+	mux.HandleFunc("/cards/delete", app.handleDeleteCard)
+	mux.HandleFunc("/cards/restore", app.handleRestoreCard)
+	mux.HandleFunc("/trash", app.handleTrash)
+	mux.HandleFunc("/import", app.handleImport)
+	mux.HandleFunc("/import/json", app.handleImportJSON)
+	mux.HandleFunc("/export", app.handleExport)
+	mux.HandleFunc("/export/anki", app.handleExportAnki)
+	mux.HandleFunc("/cards/suspend", app.handleSuspendCard)
+	mux.HandleFunc("/cards/reset", app.handleResetCard)
+	mux.HandleFunc("/cards/due", app.handleSetDue)
+	mux.HandleFunc("/cards/tag", app.handleTagCard)
+	mux.HandleFunc("/cards/untag", app.handleUntagCard)
+	mux.HandleFunc("GET /cards/{headword}/history", app.handleCardHistory)
+	mux.HandleFunc("/tags", app.handleTags)
+	mux.HandleFunc("GET /audio/{headword}", app.handleAudio)
+	mux.HandleFunc("/api/next", app.handleAPINext)
+	mux.HandleFunc("/api/due/count", app.handleDueCount)
+	mux.HandleFunc("/api/grade", app.handleAPIGrade)
+	mux.HandleFunc("/api/grade/batch", app.handleAPIGradeBatch)
+	mux.HandleFunc("/api/info", app.handleInfo)
+	mux.HandleFunc("/api/tags", app.handleTags)
+	mux.HandleFunc("/api/repair", app.handleRepair)
+	mux.HandleFunc("/api/stats/reveals", app.handleRevealStats)
+	mux.HandleFunc("/retention", app.handleRetention)
+	mux.HandleFunc("/api/vacation", app.handleVacation)
+	mux.HandleFunc("/api/vacation/start", app.handleVacationStart)
+	mux.HandleFunc("/api/vacation/end", app.handleVacationEnd)
+	mux.HandleFunc("GET /api/cards/{headword}", app.handleGetCard)
+	mux.HandleFunc("/api/cards/{headword}/recompute-due", app.handleRecomputeDue)
+	mux.HandleFunc("GET /api/cards/{headword}/intervals", app.handleCardHistory)
+	mux.HandleFunc("/api/cards/{headword}/rebuild", app.handleRebuild)
+	mux.HandleFunc("/api/rebuild", app.handleRebuild)
+	mux.HandleFunc("/api/cards/{headword}/neighbors", app.handleNeighbors)
+	mux.HandleFunc("/api/cards/{headword}/new-order", app.handleSetNewOrder)
+	mux.HandleFunc("/api/new-order", app.handleBulkNewOrder)
+	mux.HandleFunc("/api/params/impact", app.handleParamImpact)
+	mux.HandleFunc("/admin/reschedule", app.handleReschedule)
+	mux.HandleFunc("/admin/reload", app.handleReload)
+	mux.HandleFunc("/admin/debug", app.handleDebug)
+	mux.HandleFunc("/admin/optimize", app.handleOptimize)
+	mux.HandleFunc("/admin/optimize/{id}", app.handleOptimizeStatus)
+
+	// Health checks and metrics sit outside auth and user scoping so a
+	// load balancer or scraper can reach them without credentials.
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", handleHealthz)
+	root.HandleFunc("/readyz", app.handleReadyz)
+	root.Handle("/metrics", promhttp.HandlerFor(app.metrics.registry, promhttp.HandlerOpts{}))
+	root.Handle("/", app.withQueryTimeout(app.withAPIKey(app.withCSRF(app.withUser(mux)))))
+	return app.countInFlight(logRequests(root))
+}
+
+// countInFlight keeps app.inFlight up to date around next.
+func (app *application) countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.inFlight.Add(1)
+		defer app.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ttsTimeout bounds one call to the TTS service. It runs apart from the
+// request's query timeout, which is sized for the database.
+const ttsTimeout = 15 * time.Second
+
+// maxAudioBytes bounds one synthesized clip.
+const maxAudioBytes = 2 << 20
+
+// ttsClient synthesizes speech through an HTTP TTS service: a POST of
+// {"text": ..., "lang": "zh-CN"} as JSON to url, with key (if any) as a
+// Bearer token, answered with MP3 audio.
+type ttsClient struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (t *ttsClient) synthesize(ctx context.Context, text string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"text": text, "lang": "zh-CN"})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "audio/mpeg")
+	if t.key != "" {
+		req.Header.Set("Authorization", "Bearer "+t.key)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tts: %s", resp.Status)
+	}
+	mp3, err := io.ReadAll(io.LimitReader(resp.Body, maxAudioBytes+1))
+	switch {
+	case err != nil:
+		return nil, err
+	case len(mp3) == 0:
+		return nil, errors.New("tts: empty response")
+	case len(mp3) > maxAudioBytes:
+		return nil, fmt.Errorf("tts: clip larger than %d bytes", maxAudioBytes)
+	}
+	return mp3, nil
+}
+
+// getCachedAudio returns the stored speech for text, or nil if there is
+// none yet.
+func getCachedAudio(ctx context.Context, pool *pgxpool.Pool, text string) ([]byte, error) {
+	var mp3 []byte
+	err := pool.QueryRow(ctx, `select mp3 from audio_cache where text = $1`, text).Scan(&mp3)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return mp3, err
+}
+
+func putCachedAudio(ctx context.Context, pool *pgxpool.Pool, text string, mp3 []byte) error {
+	_, err := pool.Exec(ctx, `insert into audio_cache (text, mp3) values ($1, $2) on conflict (text) do nothing`, text, mp3)
+	return err
+}
+
+// handleAudio serves a card's headword as MP3. The first request for a
+// headword synthesizes it through app.tts and stores it in audio_cache;
+// later ones, from any deck, are served from there.
+func (app *application) handleAudio(w http.ResponseWriter, r *http.Request) {
+	card, err := app.cards.Load(r.Context(), r.PathValue("headword"), "")
+	if err != nil {
+		app.dbError(w, r, err)
 		return
 	}
-	headword := r.FormValue("front")
-	if headword == "" {
-		http.Error(w, "Sync error: refresh page", http.StatusBadRequest)
+	if card == nil {
+		http.NotFound(w, r)
 		return
 	}
-	currentCard, err := getCardByHeadword(app.db, headword)
+	mp3, err := getCachedAudio(r.Context(), app.db, card.Headword)
 	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
+		app.dbError(w, r, err)
 		return
 	}
-	if currentCard == nil {
-		http.Error(w, "Card not found", http.StatusNotFound)
+	if mp3 == nil {
+		if app.tts == nil {
+			http.Error(w, "text-to-speech is not configured", http.StatusNotFound)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), ttsTimeout)
+		defer cancel()
+		if mp3, err = app.tts.synthesize(ctx, card.Headword); err != nil {
+			slog.Warn("tts failed", "headword", card.Headword, "err", err)
+			http.Error(w, "speech synthesis failed", http.StatusBadGateway)
+			return
+		}
+		if err := putCachedAudio(ctx, app.db, card.Headword, mp3); err != nil {
+			slog.Warn("audio cache write failed", "headword", card.Headword, "err", err)
+		}
+	}
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Cache-Control", "private, max-age=604800")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(mp3))
+}
+
+// handleHealthz reports that the process is up, without touching the
+// database.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether Postgres, and the read replica if there is
+// one, are reachable.
+func (app *application) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := app.db.Ping(ctx); err != nil {
+		slog.Warn("readiness check failed", "err", err)
+		http.Error(w, "database unreachable", http.StatusServiceUnavailable)
 		return
 	}
-	if r.FormValue("front") != currentCard.Headword {
-		http.Error(w, "Sync error: refresh page", http.StatusBadRequest)
+	if app.readDB != app.db {
+		if err := app.readDB.Ping(ctx); err != nil {
+			slog.Warn("replica readiness check failed", "err", err)
+			http.Error(w, "read replica unreachable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// requestKey extracts the API key from "Authorization: Bearer <key>", or
+// from the password of Basic auth so a browser can log in to the HTML
+// pages through its own prompt.
+func requestKey(r *http.Request) string {
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(key)
+	}
+	return ""
+}
+
+// validKey compares key against every configured key in constant time.
+// All keys are checked even after a match so the timing doesn't reveal
+// which one it was.
+func (app *application) validKey(key string) bool {
+	match := 0
+	for _, k := range app.apiKeys {
+		match |= subtle.ConstantTimeCompare([]byte(key), k)
+	}
+	return match == 1
+}
+
+// withAPIKey rejects requests that don't carry one of app.apiKeys. With
+// no keys configured it lets everything through.
+func (app *application) withAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(app.apiKeys) == 0 || app.validKey(requestKey(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeJSONError(w, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="anamnesis"`)
+		app.renderError(w, http.StatusUnauthorized, "You need to sign in to see your cards.")
+	})
+}
+
+const (
+	csrfCookie = "anamnesis_csrf"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+type csrfKey struct{}
+
+// csrfToken returns the request's CSRF token, as set by withCSRF.
+func csrfToken(ctx context.Context) string {
+	tok, _ := ctx.Value(csrfKey{}).(string)
+	return tok
+}
+
+// withCSRF guards the browser-facing forms with a double-submit token: a
+// random value kept in a cookie, which every state-changing request must
+// echo in the csrf_token form field or the X-CSRF-Token header. Another
+// site can make the browser send the cookie (it is SameSite=Lax, so not
+// even that on a cross-site POST) but can't read it to fill the field.
+//
+// /api/ routes and requests with a Bearer key are exempt: browsers never
+// attach either on their own, so they can't be forged from a page. The
+// field is only read from urlencoded bodies; multipart uploads send the
+// header, so a large body isn't parsed before its handler limits it.
+func (app *application) withCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tok string
+		if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+			tok = c.Value
+		} else {
+			b := make([]byte, 16)
+			rand.Read(b)
+			tok = hex.EncodeToString(b)
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    tok,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				break
+			}
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" && r.ParseForm() == nil {
+				sent = r.PostForm.Get(csrfField)
+			}
+			// A fresh token never matches: the request came without the
+			// cookie, as a cross-site POST does.
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(tok)) != 1 {
+				app.renderError(w, http.StatusForbidden, "This form has expired. Go back, reload the page and try again.")
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey{}, tok)))
+	})
+}
+
+// statusRecorder captures the status a handler wrote, for logRequests.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// logRequests logs every request with its status and duration. Health
+// probes only log at debug level, as they arrive every few seconds.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		level := slog.LevelInfo
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// withUser resolves the request's user through app.identify and stores it
+// in the context for userID.
+func (app *application) withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.identify(r)
+		if !ok {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSONError(w, http.StatusUnauthorized, "unauthenticated")
+			} else {
+				app.renderError(w, http.StatusUnauthorized, "You need to sign in to see your cards.")
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withUserID(r.Context(), user)))
+	})
+}
+
+// withQueryTimeout gives each request a context that expires after
+// queryTimeout. Handlers pass r.Context() to every query, so a hung
+// database fails the request (as a 504, via dbStatus) instead of holding
+// it open forever.
+func (app *application) withQueryTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), app.queryTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	// The process is up even while init keeps failing.
+	if r.URL.Path == "/healthz" {
+		handleHealthz(w, r)
 		return
 	}
-	ratingInt, err := strconv.Atoi(r.FormValue("rating"))
+	a, err := getApp()
 	if err != nil {
-		http.Error(w, "Invalid rating", http.StatusBadRequest)
+		slog.Error("init failed", "err", err)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Service temporarily unavailable, try again shortly.", http.StatusServiceUnavailable)
 		return
 	}
-	grade := fsrs.Rating(ratingInt)
-	p := fsrs.DefaultParam()
-	f := fsrs.NewFSRS(p)
-	now := time.Now()
-	scheduledCards := f.Repeat(currentCard.mapToFSRS(), now)
-	result := scheduledCards[grade].Card
-	currentCard.Stability = result.Stability
-	currentCard.Difficulty = result.Difficulty
-	currentCard.State = int(result.State)
-	currentCard.Lapses = int(result.Lapses)
-	currentCard.LastReview = result.LastReview
-	currentCard.Due = result.Due
-	currentCard.Reps = int(result.Reps)
-	if err := updateCardInDB(app.db, *currentCard); err != nil {
-		http.Error(w, "Save failed", http.StatusInternalServerError)
-		return
+	a.handler.ServeHTTP(w, r)
+}
+
+// Close releases the application's connection pool.
+func (app *application) Close() {
+	app.stop()
+	app.db.Close()
+	if app.readDB != app.db {
+		app.readDB.Close()
 	}
-	http.Redirect(w, r, "/review", http.StatusSeeOther)
 }
 
-var (
-	app  *application
-	once sync.Once
-)
+// readLines feeds in's lines to a channel, closed at EOF, so a prompt
+// can wait on both the terminal and ctx.
+func readLines(in io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(in)
+		for sc.Scan() {
+			lines <- strings.TrimSpace(sc.Text())
+		}
+	}()
+	return lines
+}
 
-//go:embed templates/*.html
-var templatesFS embed.FS
+// errQuit ends reviewCLI when the user types q or closes the input.
+var errQuit = errors.New("quit")
+
+// reviewCLI is the terminal frontend: it shows the next due card's front,
+// waits for enter, shows the back and reads a 1-4 rating, until nothing
+// is due. Cards come from nextDue and grades go through gradeCard, so
+// the queue and the scheduling are those of /review.
+func (app *application) reviewCLI(ctx context.Context, in io.Reader, out io.Writer, order reviewOrder, f queueFilter) error {
+	lines := readLines(in)
+	prompt := func(msg string) (string, error) {
+		fmt.Fprint(out, msg)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case line, ok := <-lines:
+			if !ok || line == "q" {
+				return "", errQuit
+			}
+			return line, nil
+		}
+	}
+	reviewed := 0
+	defer func() {
+		fmt.Fprintf(out, "\nReviewed %d card(s).\n", reviewed)
+	}()
+	for {
+		card, err := app.nextDue(ctx, order, f)
+		if err != nil {
+			return err
+		}
+		if card == nil {
+			now := app.clock.Now()
+			next, ok, err := app.cards.NextDueAt(ctx, now, f)
+			if err != nil {
+				return err
+			}
+			if ok {
+				fmt.Fprintf(out, "Nothing due. The next card is due in %s.\n", formatCountdown(next.Sub(now)))
+			} else {
+				fmt.Fprintln(out, "Nothing due.")
+			}
+			return nil
+		}
+
+		fmt.Fprintln(out)
+		switch card.Aspect {
+		case aspectProduction:
+			fmt.Fprintf(out, "  %s\n  %s\n", card.EnDef, card.ZhDef)
+		case aspectPinyin:
+			fmt.Fprintf(out, "  %s\n  Pinyin?\n", card.Headword)
+		default:
+			fmt.Fprintf(out, "  %s\n", card.Headword)
+		}
+		if _, err := prompt("[enter] show answer, q quit: "); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "\n  %s  %s\n  %s\n  %s\n", card.Headword, card.Pinyin, card.ZhDef, card.EnDef)
+		if card.ExampleZh != "" {
+			fmt.Fprintf(out, "  %s\n", card.ExampleZh)
+			if card.ExampleEn != "" {
+				fmt.Fprintf(out, "  %s\n", card.ExampleEn)
+			}
+		}
+		s, err := app.schedFor(ctx)
+		if err != nil {
+			return err
+		}
+		iv := s.previewIntervals(*card, app.clock.Now())
+		var buttons []string
+		for _, g := range s.gradeButtons.ratings() {
+			buttons = append(buttons, fmt.Sprintf("%d %s %s", g, g, formatInterval(iv[g])))
+		}
+		msg := strings.Join(buttons, " · ") + ", q quit: "
+		var grade fsrs.Rating
+		for !slices.Contains(s.gradeButtons.ratings(), grade) {
+			line, err := prompt(msg)
+			if err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(line)
+			grade = fsrs.Rating(n)
+		}
+
+		shown := *card
+		graded, err := app.gradeCard(ctx, card.Headword, card.Aspect, grade, app.clock.Now(), func(c Card) error {
+			if c.Reps != shown.Reps || c.Version != shown.Version {
+				return errStaleCard
+			}
+			return nil
+		})
+		switch {
+		case errors.Is(err, errStaleCard):
+			fmt.Fprintln(out, "This card changed since it was shown; not graded.")
+		case err != nil:
+			return err
+		case graded == nil:
+			fmt.Fprintln(out, "This card no longer exists; not graded.")
+		default:
+			reviewed++
+			fmt.Fprintf(out, "Next review in %s.\n", formatInterval(graded.Due.Sub(app.clock.Now())))
+		}
+	}
+}
+
+// runReview is Main's review subcommand, which drills in the terminal
+// instead of serving. Flags mirror /review's query parameters.
+func runReview(ctx context.Context, args []string) error {
+	fl := flag.NewFlagSet("review", flag.ContinueOnError)
+	orderFlag := fl.String("order", "", "review order: due, freq or random (default: the configured order)")
+	hskFlag := fl.String("hsk", "", "only review this HSK level")
+	tagFlag := fl.String("tag", "", "only review cards with this tag")
+	user := fl.String("user", defaultUser, "the user whose deck to review")
+	if err := fl.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	hsk, err := parseHSKLevel(*hskFlag)
+	if err != nil {
+		return err
+	}
+	tag, err := parseTag(*tagFlag)
+	if err != nil {
+		return fmt.Errorf("tag: %w", err)
+	}
+	a, err := getApp()
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	defer a.Close()
+	order := a.sched.Load().reviewOrder
+	if *orderFlag != "" {
+		if order, err = parseReviewOrder(*orderFlag); err != nil {
+			return err
+		}
+	}
+	err = a.reviewCLI(withUserID(ctx, *user), os.Stdin, os.Stdout, order, queueFilter{HSK: hsk, Tag: tag})
+	if errors.Is(err, errQuit) || errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
 
-func initApp() {
+// runMigrations is Main's -migrate mode: it connects to the primary with
+// the usual environment, applies (or, with baseline, records) pending
+// migrations and returns without starting the app.
+func runMigrations(ctx context.Context, baseline int) error {
+	if err := loadEnvFile(os.Getenv("ENV_FILE")); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
 	cfg, err := loadDBConfigFromEnv()
 	if err != nil {
-		panic(fmt.Sprintf("Config error: %v", err))
+		return fmt.Errorf("config: %w", err)
 	}
+	slog.SetDefault(newLogger(cfg))
 	kairosURL, err := buildPostgresURL(cfg, cfg.KairosDB)
 	if err != nil {
-		panic(fmt.Sprintf("DB URL error: %v", err))
+		return fmt.Errorf("db url: %w", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	dbPool, err := pgxpool.New(ctx, kairosURL)
+	poolCfg, err := newPoolConfig(cfg, kairosURL, newMetrics())
 	if err != nil {
-		panic(fmt.Sprintf("DB connect error: %v", err))
+		return err
 	}
-	tmpl := template.Must(template.New("").ParseFS(templatesFS, "*.html"))
-
-	app = &application{
-		db:   dbPool,
-		tmpl: tmpl,
+	pool, err := connectPool(ctx, poolCfg, cfg.ConnectRetries)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	applied, err := migrate(ctx, pool, baseline)
+	for _, name := range applied {
+		slog.Info("applied migration", "name", name, "baseline", baseline > 0)
 	}
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if len(applied) == 0 {
+		slog.Info("schema is up to date")
+	}
+	return nil
 }
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	once.Do(initApp)
-	mux := http.NewServeMux()
-	mux.HandleFunc("/review", app.handleReview)
-	mux.HandleFunc("/reveal", app.handleReveal)
-	mux.HandleFunc("/grade", app.handleGrade)
-	mux.ServeHTTP(w, r)
+// Main runs the app as a long-lived server, for local use outside the
+// serverless deploy. Package handler cannot be a main package, so
+// cmd/anamnesis is the binary that calls this.
+//
+// On SIGINT or SIGTERM it stops accepting connections and waits up to
+// SHUTDOWN_TIMEOUT for in-flight requests to finish before closing the
+// pool, so a grade that has started commits rather than being cut off.
+// A grade is one transaction either way (see gradeCard): past the
+// timeout the remaining connections are closed, which cancels their
+// requests' contexts and rolls their transactions back, and closing the
+// pool still waits for those connections to be released. A second
+// signal during the wait kills the process outright.
+//
+// With -migrate it only applies pending migrations; -migrate-baseline=N
+// records 1..N as applied without running them, for a database migrated
+// by hand before the runner existed. "anamnesis review" drills in the
+// terminal instead (see runReview).
+func Main() {
+	migrateOnly := flag.Bool("migrate", false, "apply pending migrations and exit")
+	baseline := flag.Int("migrate-baseline", 0, "record migrations up to this version as applied, without running them, and exit")
+	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *migrateOnly || *baseline > 0 {
+		if err := runMigrations(ctx, *baseline); err != nil {
+			slog.Error("migrate failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "review" {
+		if err := runReview(ctx, flag.Args()[1:]); err != nil {
+			slog.Error("review failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	a, err := getApp()
+	if err != nil {
+		slog.Error("init failed", "err", err)
+		os.Exit(1)
+	}
+	defer a.Close()
+
+	srv := &http.Server{
+		Addr:              ":" + getenvDefault("PORT", "8080"),
+		Handler:           a.handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		slog.Error("server stopped", "err", err)
+		return
+	case <-ctx.Done():
+	}
+	// Restore the default handling, so another signal ends the wait.
+	stop()
+	a.shutdown(srv)
 }
 
-func main() {}
+// shutdown stops srv accepting connections and waits up to
+// ShutdownTimeout for its in-flight requests to finish, then closes
+// whatever connections are left. The pool is for the caller to close
+// once it returns.
+func (app *application) shutdown(srv *http.Server) {
+	draining := app.inFlight.Load()
+	slog.Info("shutting down", "in_flight", draining, "timeout", app.config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		left := app.inFlight.Load()
+		slog.Error("shutdown timed out, closing remaining connections", "err", err, "drained", max(draining-left, 0), "abandoned", left)
+		srv.Close()
+		return
+	}
+	slog.Info("shutdown complete", "drained", draining)
+}
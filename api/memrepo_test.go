@@ -0,0 +1,410 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-spaced-repetition/go-fsrs/v3"
+)
+
+// memCardRepo is an in-memory CardRepository for tests. A transaction
+// holds the store's lock from start to end, which serializes it against
+// every other call the way Postgres' row lock serializes two grades of
+// one card, and a failed transaction (or savepoint) restores the store
+// as it was. Methods the tests don't use fall through to the nil
+// embedded interface and panic.
+type memCardRepo struct {
+	CardRepository
+	st      *memStore
+	aspects []string
+	inTx    bool
+}
+
+type memStore struct {
+	mu      sync.Mutex
+	cards   map[memKey]Card
+	deleted map[memKey]time.Time // recognition keys of trashed entries
+	leech   map[memKey]bool
+	log     []memReview
+	params  map[string]memParams
+}
+
+// memKey names one scheduled row; aspect is "" for recognition, as on
+// the cards cardQuery scans.
+type memKey struct {
+	user, headword, aspect string
+}
+
+type memReview struct {
+	user          string
+	before, after Card
+	rating        fsrs.Rating
+	at            time.Time
+}
+
+type memParams struct {
+	w         fsrs.Weights
+	retention float64
+}
+
+func newMemCardRepo(aspects ...string) memCardRepo {
+	return memCardRepo{st: &memStore{
+		cards:   map[memKey]Card{},
+		deleted: map[memKey]time.Time{},
+		leech:   map[memKey]bool{},
+		params:  map[string]memParams{},
+	}, aspects: aspects}
+}
+
+func memKeyOf(ctx context.Context, headword, aspect string) memKey {
+	if aspect == aspectRecognition {
+		aspect = ""
+	}
+	return memKey{userID(ctx), headword, aspect}
+}
+
+// lock takes the store's lock unless the caller's transaction holds it.
+func (r memCardRepo) lock() func() {
+	if r.inTx {
+		return func() {}
+	}
+	r.st.mu.Lock()
+	return r.st.mu.Unlock
+}
+
+// put stores c for the default user as it is, schedule and version
+// included, for setting up a test.
+func (r memCardRepo) put(t testing.TB, c Card) {
+	t.Helper()
+	defer r.lock()()
+	r.st.cards[memKeyOf(context.Background(), c.Headword, c.Aspect)] = c
+}
+
+// get returns the stored card for the default user, failing the test if
+// there is none.
+func (r memCardRepo) get(t testing.TB, headword, aspect string) Card {
+	t.Helper()
+	defer r.lock()()
+	c, ok := r.st.cards[memKeyOf(context.Background(), headword, aspect)]
+	if !ok {
+		t.Fatalf("no card %q/%q", headword, aspect)
+	}
+	return c
+}
+
+// reviews returns how many grades have been logged.
+func (r memCardRepo) reviews() int {
+	defer r.lock()()
+	return len(r.st.log)
+}
+
+// live reports whether k is a card the queue may show: not trashed, its
+// entry not suspended, and its aspect enabled.
+func (r memCardRepo) live(k memKey) bool {
+	entry := memKey{k.user, k.headword, ""}
+	if _, trashed := r.st.deleted[entry]; trashed {
+		return false
+	}
+	if r.st.cards[entry].Suspended {
+		return false
+	}
+	return k.aspect == "" || slices.Contains(r.aspects, k.aspect)
+}
+
+func (r memCardRepo) matching(ctx context.Context, f queueFilter, keep func(Card) bool) []Card {
+	var out []Card
+	for k, c := range r.st.cards {
+		if k.user != userID(ctx) || !r.live(k) {
+			continue
+		}
+		entry := r.st.cards[memKey{k.user, k.headword, ""}]
+		if f.HSK != 0 && entry.HSK != f.HSK || f.Tag != "" && !slices.Contains(entry.Tags, f.Tag) || f.NoNew && c.State == int(fsrs.New) {
+			continue
+		}
+		if keep(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (r memCardRepo) NextDue(ctx context.Context, order reviewOrder, now time.Time, f queueFilter) (*Card, error) {
+	defer r.lock()()
+	due := r.matching(ctx, f, func(c Card) bool { return !c.Due.After(now) })
+	if len(due) == 0 {
+		return nil, nil
+	}
+	slices.SortFunc(due, func(a, b Card) int {
+		if order == orderFreq {
+			if c := cmp.Compare(b.Freq, a.Freq); c != 0 {
+				return c
+			}
+		}
+		return cmp.Or(a.Due.Compare(b.Due), cmp.Compare(a.Headword, b.Headword), cmp.Compare(a.Aspect, b.Aspect))
+	})
+	return &due[0], nil
+}
+
+func (r memCardRepo) LearnAhead(ctx context.Context, until time.Time, f queueFilter) (*Card, error) {
+	defer r.lock()()
+	learning := r.matching(ctx, f, func(c Card) bool {
+		return (c.State == int(fsrs.Learning) || c.State == int(fsrs.Relearning)) && !c.Due.After(until)
+	})
+	if len(learning) == 0 {
+		return nil, nil
+	}
+	c := slices.MinFunc(learning, func(a, b Card) int { return a.Due.Compare(b.Due) })
+	return &c, nil
+}
+
+func (r memCardRepo) Cram(ctx context.Context, pos int) (*Card, error) {
+	defer r.lock()()
+	deck := r.matching(ctx, queueFilter{}, func(c Card) bool { return c.Aspect == "" })
+	slices.SortFunc(deck, func(a, b Card) int {
+		return cmp.Or(cmp.Compare(b.Difficulty, a.Difficulty), cmp.Compare(b.Freq, a.Freq), cmp.Compare(a.Headword, b.Headword))
+	})
+	if pos >= len(deck) {
+		return nil, nil
+	}
+	return &deck[pos], nil
+}
+
+func (r memCardRepo) Load(ctx context.Context, headword, aspect string) (*Card, error) {
+	defer r.lock()()
+	k := memKeyOf(ctx, headword, aspect)
+	if k.aspect != "" && !slices.Contains(r.aspects, k.aspect) {
+		return nil, nil
+	}
+	if _, trashed := r.st.deleted[memKey{k.user, k.headword, ""}]; trashed {
+		return nil, nil
+	}
+	c, ok := r.st.cards[k]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+func (r memCardRepo) Lock(ctx context.Context, headword, aspect string) (*Card, error) {
+	return r.Load(ctx, headword, aspect)
+}
+
+func (r memCardRepo) CountDue(ctx context.Context, now time.Time) (dueCounts, error) {
+	defer r.lock()()
+	var n dueCounts
+	for _, c := range r.matching(ctx, queueFilter{}, func(c Card) bool { return !c.Due.After(now) }) {
+		if c.State == int(fsrs.New) {
+			n.New++
+		} else {
+			n.Due++
+		}
+	}
+	return n, nil
+}
+
+func (r memCardRepo) NextDueAt(ctx context.Context, now time.Time, f queueFilter) (time.Time, bool, error) {
+	defer r.lock()()
+	later := r.matching(ctx, f, func(c Card) bool { return c.Due.After(now) })
+	if len(later) == 0 {
+		return time.Time{}, false, nil
+	}
+	return slices.MinFunc(later, func(a, b Card) int { return a.Due.Compare(b.Due) }).Due, true, nil
+}
+
+func (r memCardRepo) Create(ctx context.Context, c Card, now time.Time) error {
+	defer r.lock()()
+	k := memKeyOf(ctx, c.Headword, "")
+	if _, ok := r.st.cards[k]; ok {
+		return errCardExists
+	}
+	c.Aspect, c.Stability, c.Difficulty, c.Lapses, c.State, c.Reps, c.Version = "", 0, 0, 0, 0, 0, 0
+	c.LastReview, c.Due = now, now
+	r.st.cards[k] = c
+	for _, a := range r.aspects {
+		ac := c
+		ac.Aspect = a
+		r.st.cards[memKey{k.user, k.headword, a}] = ac
+	}
+	return nil
+}
+
+func (r memCardRepo) UpdateContent(ctx context.Context, c Card) error {
+	defer r.lock()()
+	for k, cur := range r.st.cards {
+		if k.user != userID(ctx) || k.headword != c.Headword {
+			continue
+		}
+		cur.Pinyin, cur.EnDef, cur.ZhDef, cur.Freq = c.Pinyin, c.EnDef, c.ZhDef, c.Freq
+		cur.ExampleZh, cur.ExampleEn, cur.HSK = c.ExampleZh, c.ExampleEn, c.HSK
+		r.st.cards[k] = cur
+	}
+	return nil
+}
+
+func (r memCardRepo) SaveSchedule(ctx context.Context, c *Card) error {
+	defer r.lock()()
+	k := memKeyOf(ctx, c.Headword, c.Aspect)
+	cur, ok := r.st.cards[k]
+	if !ok || cur.Version != c.Version {
+		return errStaleCard
+	}
+	cur.Stability, cur.Difficulty, cur.Lapses, cur.State = c.Stability, c.Difficulty, c.Lapses, c.State
+	cur.LastReview, cur.Due, cur.Reps = c.LastReview, c.Due, c.Reps
+	cur.Version++
+	r.st.cards[k] = cur
+	c.Version++
+	return nil
+}
+
+func (r memCardRepo) LogReview(ctx context.Context, before, after Card, rating fsrs.Rating, at time.Time) error {
+	defer r.lock()()
+	r.st.log = append(r.st.log, memReview{userID(ctx), before, after, rating, at})
+	return nil
+}
+
+func (r memCardRepo) MarkLeech(ctx context.Context, headword string, suspend bool) error {
+	defer r.lock()()
+	k := memKeyOf(ctx, headword, "")
+	r.st.leech[k] = true
+	if c, ok := r.st.cards[k]; ok && suspend {
+		c.Suspended = true
+		r.st.cards[k] = c
+	}
+	return nil
+}
+
+func (r memCardRepo) Delete(ctx context.Context, headword string) (bool, error) {
+	defer r.lock()()
+	k := memKeyOf(ctx, headword, "")
+	if _, ok := r.st.cards[k]; !ok {
+		return false, nil
+	}
+	if _, trashed := r.st.deleted[k]; trashed {
+		return false, nil
+	}
+	r.st.deleted[k] = time.Now()
+	return true, nil
+}
+
+func (r memCardRepo) Undelete(ctx context.Context, headword string) (bool, error) {
+	defer r.lock()()
+	k := memKeyOf(ctx, headword, "")
+	if _, trashed := r.st.deleted[k]; !trashed {
+		return false, nil
+	}
+	delete(r.st.deleted, k)
+	return true, nil
+}
+
+func (r memCardRepo) ToggleSuspended(ctx context.Context, headword string) (bool, bool, error) {
+	defer r.lock()()
+	k := memKeyOf(ctx, headword, "")
+	c, ok := r.st.cards[k]
+	if _, trashed := r.st.deleted[k]; !ok || trashed {
+		return false, false, nil
+	}
+	c.Suspended = !c.Suspended
+	r.st.cards[k] = c
+	return c.Suspended, true, nil
+}
+
+func (r memCardRepo) UndoLast(ctx context.Context) (string, string, bool, error) {
+	defer r.lock()()
+	for i := len(r.st.log) - 1; i >= 0; i-- {
+		rv := r.st.log[i]
+		if rv.user != userID(ctx) {
+			continue
+		}
+		k := memKeyOf(ctx, rv.before.Headword, rv.before.Aspect)
+		if cur, ok := r.st.cards[k]; ok {
+			restored := rv.before
+			restored.Version = cur.Version + 1
+			restored.Suspended = cur.Suspended
+			r.st.cards[k] = restored
+		}
+		r.st.log = slices.Delete(r.st.log, i, i+1)
+		return rv.before.Headword, rv.before.Aspect, true, nil
+	}
+	return "", "", false, nil
+}
+
+func (r memCardRepo) ReviewDays(ctx context.Context, loc *time.Location) ([]time.Time, error) {
+	defer r.lock()()
+	var days []time.Time
+	for _, rv := range r.st.log {
+		if rv.user != userID(ctx) {
+			continue
+		}
+		y, m, d := rv.at.In(loc).Date()
+		days = append(days, time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+	}
+	slices.SortFunc(days, time.Time.Compare)
+	return slices.CompactFunc(days, time.Time.Equal), nil
+}
+
+func (r memCardRepo) CountIntroduced(ctx context.Context, since time.Time) (int, error) {
+	defer r.lock()()
+	var n int
+	for _, rv := range r.st.log {
+		if rv.user == userID(ctx) && rv.before.State == int(fsrs.New) && !rv.at.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r memCardRepo) ReviewLog(ctx context.Context, headword string) ([]loggedCard, error) {
+	defer r.lock()()
+	byCard := map[memKey]*loggedCard{}
+	var order []memKey
+	for _, rv := range r.st.log {
+		if rv.user != userID(ctx) || headword != "" && rv.before.Headword != headword {
+			continue
+		}
+		k := memKeyOf(ctx, rv.before.Headword, rv.before.Aspect)
+		lc, ok := byCard[k]
+		if !ok {
+			lc = &loggedCard{headword: k.headword, aspect: cmp.Or(k.aspect, aspectRecognition)}
+			byCard[k] = lc
+			order = append(order, k)
+		}
+		lc.reviews = append(lc.reviews, historyReview{rating: rv.rating, at: rv.at, fresh: rv.before.State == int(fsrs.New)})
+	}
+	logged := make([]loggedCard, len(order))
+	for i, k := range order {
+		logged[i] = *byCard[k]
+	}
+	return logged, nil
+}
+
+func (r memCardRepo) UserParams(ctx context.Context) (fsrs.Weights, float64, bool, error) {
+	defer r.lock()()
+	p, ok := r.st.params[userID(ctx)]
+	return p.w, p.retention, ok, nil
+}
+
+func (r memCardRepo) InTx(ctx context.Context, fn func(CardRepository) error) error {
+	if !r.inTx {
+		r.st.mu.Lock()
+		defer r.st.mu.Unlock()
+	}
+	saved := memStore{
+		cards:   maps.Clone(r.st.cards),
+		deleted: maps.Clone(r.st.deleted),
+		leech:   maps.Clone(r.st.leech),
+		log:     slices.Clone(r.st.log),
+		params:  maps.Clone(r.st.params),
+	}
+	tx := r
+	tx.inTx = true
+	if err := fn(tx); err != nil {
+		r.st.cards, r.st.deleted, r.st.leech, r.st.log, r.st.params = saved.cards, saved.deleted, saved.leech, saved.log, saved.params
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+-- Per-aspect scheduling for entries. The base "recognition" aspect keeps
+-- using the scheduling columns on entries; every other enabled aspect gets
+-- its own FSRS state here, keyed by (headword, aspect).
+create table if not exists card_aspects (
+    headword    text        not null references entries (headword) on delete cascade,
+    aspect      text        not null,
+    stability   float8      not null default 0,
+    difficulty  float8      not null default 0,
+    lapses      integer     not null default 0,
+    state       integer     not null default 0,
+    last_review timestamptz not null default now(),
+    due_at      timestamptz not null default now(),
+    reps_ct     integer     not null default 0,
+    primary key (headword, aspect)
+);
+
+create index if not exists card_aspects_due_idx on card_aspects (aspect, due_at);
@@ -0,0 +1,7 @@
+-- Small key/value store for runtime state that must survive restarts and
+-- be shared between serverless instances (e.g. vacation mode).
+create table if not exists settings (
+    key        text        primary key,
+    value      jsonb       not null,
+    updated_at timestamptz not null default now()
+);
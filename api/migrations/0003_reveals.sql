@@ -0,0 +1,12 @@
+-- One row per answer reveal. graded_at is filled in when the same session
+-- grades the card, so reveals that stay ungraded are drop-offs.
+create table if not exists reveals (
+    id          bigserial   primary key,
+    headword    text        not null,
+    aspect      text        not null,
+    session     text        not null,
+    revealed_at timestamptz not null default now(),
+    graded_at   timestamptz
+);
+
+create index if not exists reveals_lookup_idx on reveals (session, headword, aspect, revealed_at desc);
@@ -0,0 +1,5 @@
+-- Manual introduction order for new cards. Lower values come first; cards
+-- without one fall back to frequency order after all ordered cards.
+alter table entries add column if not exists new_order integer;
+
+create index if not exists entries_new_order_idx on entries (new_order) where state = 0;
@@ -0,0 +1,24 @@
+-- One row per grade. The old_* columns are the card's full schedule before
+-- the review so a grade can be undone exactly; the new_* columns are what
+-- FSRS produced.
+create table if not exists review_log (
+    id              bigserial   primary key,
+    headword        text        not null,
+    aspect          text        not null default 'recognition',
+    rating          smallint    not null,
+    old_stability   float8      not null,
+    new_stability   float8      not null,
+    old_difficulty  float8      not null,
+    new_difficulty  float8      not null,
+    old_state       integer     not null,
+    new_state       integer     not null,
+    old_lapses      integer     not null,
+    old_reps        integer     not null,
+    old_last_review timestamptz,
+    old_due         timestamptz not null,
+    new_due         timestamptz not null,
+    reviewed_at     timestamptz not null default now()
+);
+
+create index if not exists review_log_headword_idx on review_log (headword, aspect, reviewed_at);
+create index if not exists review_log_reviewed_at_idx on review_log (reviewed_at);
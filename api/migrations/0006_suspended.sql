@@ -0,0 +1,2 @@
+-- Suspended cards keep their schedule and history but leave the queue.
+alter table entries add column if not exists suspended boolean not null default false;
@@ -0,0 +1,29 @@
+-- Scope every card, schedule, log and setting to a user so one instance
+-- can hold several decks. Existing rows go to the 'default' user, which is
+-- who every request acts as when USER_HEADER is unset.
+alter table entries add column if not exists user_id text not null default 'default';
+alter table card_aspects add column if not exists user_id text not null default 'default';
+alter table review_log add column if not exists user_id text not null default 'default';
+alter table reveals add column if not exists user_id text not null default 'default';
+alter table settings add column if not exists user_id text not null default 'default';
+
+-- A headword is unique per user, not globally. card_aspects' foreign key
+-- has to follow the new key, so it is dropped first and recreated.
+alter table card_aspects drop constraint if exists card_aspects_headword_fkey;
+alter table card_aspects drop constraint if exists card_aspects_pkey;
+alter table entries drop constraint if exists entries_pkey;
+alter table entries add primary key (user_id, headword);
+alter table card_aspects add primary key (user_id, headword, aspect);
+alter table card_aspects add constraint card_aspects_entry_fkey
+    foreign key (user_id, headword) references entries (user_id, headword) on delete cascade;
+
+alter table settings drop constraint if exists settings_pkey;
+alter table settings add primary key (user_id, key);
+
+drop index if exists card_aspects_due_idx;
+create index if not exists card_aspects_due_idx on card_aspects (user_id, aspect, due_at);
+create index if not exists entries_user_due_idx on entries (user_id, due_at);
+drop index if exists review_log_headword_idx;
+create index if not exists review_log_headword_idx on review_log (user_id, headword, aspect, reviewed_at);
+drop index if exists reveals_lookup_idx;
+create index if not exists reveals_lookup_idx on reveals (user_id, session, headword, aspect, revealed_at desc);
@@ -0,0 +1,5 @@
+-- Cards that keep lapsing are flagged once their lapses reach
+-- LEECH_THRESHOLD, and optionally suspended at the same time.
+alter table entries add column if not exists leech boolean not null default false;
+
+create index if not exists entries_leech_idx on entries (user_id) where leech;
@@ -0,0 +1,3 @@
+-- Optional context sentence for each entry, shown on the answer side.
+alter table entries add column if not exists example_sentence_zh text;
+alter table entries add column if not exists example_sentence_en text;
@@ -0,0 +1,3 @@
+-- HSK band (1..9) of each entry; null for words outside the syllabus.
+alter table entries add column if not exists hsk_level smallint check (hsk_level between 1 and 9);
+create index if not exists entries_user_hsk_due_idx on entries (user_id, hsk_level, due_at);
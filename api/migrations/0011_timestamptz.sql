@@ -0,0 +1,21 @@
+-- Every stored moment is a timestamptz (an absolute instant). Convert any
+-- column still created as timestamp without time zone, reading its values
+-- as UTC, which is what the app has always written.
+do $$
+declare
+    col record;
+begin
+    for col in
+        select table_name, column_name
+        from information_schema.columns
+        where table_schema = current_schema()
+          and table_name in ('entries', 'card_aspects', 'review_log', 'reveals', 'settings')
+          and data_type = 'timestamp without time zone'
+    loop
+        execute format(
+            'alter table %I alter column %I type timestamptz using %I at time zone ''UTC''',
+            col.table_name, col.column_name, col.column_name
+        );
+    end loop;
+end
+$$;
@@ -0,0 +1,4 @@
+-- Optimistic concurrency: every schedule write bumps version, and a graded
+-- write only lands if version is still what was read.
+alter table entries add column if not exists version integer not null default 0;
+alter table card_aspects add column if not exists version integer not null default 0;
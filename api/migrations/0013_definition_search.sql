@@ -0,0 +1,8 @@
+-- Full-text search over the definitions: English stemmed, Chinese (and
+-- anything else) word for word.
+alter table entries add column if not exists definition_tsv tsvector
+    generated always as (
+        to_tsvector('english', coalesce(english_definition, ''))
+        || to_tsvector('simple', coalesce(chinese_definition, ''))
+    ) stored;
+create index if not exists entries_definition_tsv_idx on entries using gin (definition_tsv);
@@ -0,0 +1,3 @@
+-- Free-form tags for grouping cards; kept sorted and distinct by the app.
+alter table entries add column if not exists tags text[] not null default '{}';
+create index if not exists entries_tags_idx on entries using gin (tags);
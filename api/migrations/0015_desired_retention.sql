@@ -0,0 +1,2 @@
+-- Per-card target recall probability; null uses DESIRED_RETENTION.
+alter table entries add column if not exists desired_retention float8 check (desired_retention > 0 and desired_retention < 1);
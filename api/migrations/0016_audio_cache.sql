@@ -0,0 +1,7 @@
+-- Synthesized speech for a headword, shared by every user's deck so each
+-- text is only sent to the TTS service once.
+create table if not exists audio_cache (
+    text       text        primary key,
+    mp3        bytea       not null,
+    created_at timestamptz not null default now()
+);
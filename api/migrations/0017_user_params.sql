@@ -0,0 +1,8 @@
+-- Each user's own FSRS parameters, written by /admin/optimize. Users
+-- without a row are scheduled with FSRS_WEIGHTS and DESIRED_RETENTION.
+create table if not exists user_params (
+    user_id           text        primary key,
+    weights           float8[]    not null,
+    desired_retention float8      not null,
+    updated_at        timestamptz not null default now()
+);
@@ -0,0 +1,4 @@
+-- Deleting a card moves it to the trash instead of dropping the row, so
+-- its schedule, aspects and review history survive and it can be
+-- restored. Every read skips rows with deleted_at set.
+alter table entries add column if not exists deleted_at timestamptz;
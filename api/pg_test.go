@@ -0,0 +1,848 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/open-spaced-repetition/go-fsrs/v3"
+)
+
+// testPool connects to the Postgres named by TEST_DATABASE_URL, skipping
+// the test when it is unset, and gives the test a schema of its own:
+// testdata/base_schema.sql with every migration applied. The schema is
+// dropped when the test ends.
+func testPool(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	b := make([]byte, 6)
+	rand.Read(b)
+	schema := "test_" + hex.EncodeToString(b)
+
+	admin, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Exec(ctx, "create schema "+schema); err != nil {
+		admin.Close(ctx)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(ctx, "drop schema "+schema+" cascade"); err != nil {
+			t.Errorf("drop %s: %v", schema, err)
+		}
+		admin.Close(ctx)
+	})
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	base, err := os.ReadFile("testdata/base_schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, string(base)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate(ctx, pool, 0); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestRepairCardStates(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	type sched struct {
+		state, reps, lapses   int
+		stability, difficulty float64
+	}
+	tests := []struct {
+		headword string
+		rule     string // "" for a card no rule should touch
+		before   sched
+		want     sched
+	}{
+		{"无效", "invalid_state", sched{7, 3, 1, 5, 5}, sched{0, 0, 0, 0, 0}},
+		{"无稳", "reviewed_without_stability", sched{2, 3, 1, 0, 5}, sched{0, 0, 0, 0, 0}},
+		{"新历", "new_with_history", sched{0, 2, 1, 0, 0}, sched{0, 0, 0, 0, 0}},
+		{"无次", "reviewed_without_reps", sched{2, 0, 0, 3, 5}, sched{1, 1, 0, 3, 5}},
+		{"重学", "reviewed_without_reps", sched{3, 0, 0, 3, 5}, sched{1, 1, 0, 3, 5}},
+		{"学习", "reviewed_without_reps", sched{1, 0, 0, 3, 5}, sched{1, 1, 0, 3, 5}},
+		{"多忘", "lapses_exceed_reps", sched{2, 2, 5, 3, 5}, sched{2, 2, 2, 3, 5}},
+		{"健康", "", sched{2, 4, 1, 3, 5}, sched{2, 4, 1, 3, 5}},
+	}
+	for _, tt := range tests {
+		b := tt.before
+		if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, state, reps_ct, lapses, stability, difficulty)
+values ($1, 'x', 'x', $2, $3, $4, $5, $6)`, tt.headword, b.state, b.reps, b.lapses, b.stability, b.difficulty); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dry, err := repairCardStates(ctx, pool, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := repairCardStates(ctx, pool, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dry, report) {
+		t.Errorf("dry run reported %v, the real run %v", dry, report)
+	}
+	for _, tt := range tests {
+		t.Run(tt.headword, func(t *testing.T) {
+			var got sched
+			var version int
+			err := pool.QueryRow(ctx, `select state, reps_ct, lapses, stability, difficulty, version from entries where headword = $1`, tt.headword).
+				Scan(&got.state, &got.reps, &got.lapses, &got.stability, &got.difficulty, &version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("after repair %+v, want %+v", got, tt.want)
+			}
+			for rule, headwords := range report {
+				if fixed := slices.Contains(headwords, tt.headword); fixed != (rule == tt.rule) {
+					t.Errorf("rule %s reported %v", rule, headwords)
+				}
+			}
+			if tt.rule != "" && !slices.Contains(report[tt.rule], tt.headword) {
+				t.Errorf("rule %s didn't report it: %v", tt.rule, report)
+			}
+			if (version == 0) != (tt.rule == "") {
+				t.Errorf("version = %d", version)
+			}
+		})
+	}
+
+	if again, err := repairCardStates(ctx, pool, false); err != nil || len(again) != 0 {
+		t.Errorf("second repair = %v, %v; want nothing left to fix", again, err)
+	}
+}
+
+// BenchmarkGetCardByHeadword compares looking a card up with pgx parsing
+// and planning the query on every call (exec) against the default of a
+// prepared statement cached per connection (cache_statement).
+func BenchmarkGetCardByHeadword(b *testing.B) {
+	pool := testPool(b)
+	ctx := context.Background()
+	if _, err := pool.Exec(ctx, `insert into entries (headword, pinyin, english_definition) values ('好', 'hǎo', 'good')`); err != nil {
+		b.Fatal(err)
+	}
+	for _, mode := range []string{"exec", "cache_statement"} {
+		b.Run(mode, func(b *testing.B) {
+			cfg := pool.Config()
+			cfg.ConnConfig.DefaultQueryExecMode = queryExecModes[mode]
+			p, err := pgxpool.NewWithConfig(ctx, cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.Close()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := getCardByHeadword(ctx, p, "好"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// dumpDeck collects exportDeck's output as /export would serve it.
+func dumpDeck(t *testing.T, db txBeginner) []byte {
+	t.Helper()
+	cards := []exportedCard{}
+	if err := exportDeck(context.Background(), db, func(c exportedCard) error {
+		cards = append(cards, c)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(cards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Restoring an export into an empty deck and exporting that again gives
+// the same dump: every column, NULLs and aspects included, comes back.
+func TestExportRestoreRoundTrip(t *testing.T) {
+	src, dst := testPool(t), testPool(t)
+	ctx := context.Background()
+	reviewed := time.Date(2026, 3, 1, 9, 30, 15, 123456000, time.UTC)
+	if _, err := src.Exec(ctx, `
+insert into entries (
+headword, pinyin, english_definition, chinese_definition, freq,
+example_sentence_zh, example_sentence_en, hsk_level, desired_retention, new_order,
+stability, difficulty, lapses, state, last_review, due_at, reps_ct,
+suspended, leech, tags
+) values
+('学习', 'xuéxí', 'to study', '学而时习之', 120, '我学习中文。', 'I study Chinese.', 1, 0.85, 3,
+ 12.5, 4.25, 2, 2, $1::timestamptz, $1::timestamptz + interval '13 days 2 hours', 9, true, true, '{hsk1,verbs}'),
+('新', 'xīn', 'new', '', null, null, null, null, null, null,
+ 0, 0, 0, 0, $1::timestamptz, $1::timestamptz, 0, false, false, '{}')
+`, reviewed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Exec(ctx, `
+insert into card_aspects (headword, aspect, stability, difficulty, lapses, state, last_review, due_at, reps_ct)
+values ('学习', 'production', 3.5, 6.75, 1, 3, $1::timestamptz, $1::timestamptz + interval '10 minutes', 4)
+`, reviewed); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := dumpDeck(t, src)
+	rep, err := restoreDeck(ctx, dst, bytes.NewReader(dump), reviewed.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Inserted != 2 || rep.Updated != 0 || len(rep.Errors) != 0 {
+		t.Fatalf("restore report = %+v, want 2 inserted", rep)
+	}
+	if again := dumpDeck(t, dst); !bytes.Equal(again, dump) {
+		t.Errorf("round trip changed the deck:\nexported %s\nrestored %s", dump, again)
+	}
+}
+
+// pgTestApp is newTestApp over testPool's database instead of the fake.
+func pgTestApp(t *testing.T) (*application, *testClock, *pgxpool.Pool) {
+	t.Helper()
+	pool := testPool(t)
+	app, clk := newTestApp(t, newMemCardRepo())
+	app.db, app.readDB = pool, pool
+	app.cards = pgxCardRepo{db: pool}
+	app.readCards = app.cards
+	return app, clk, pool
+}
+
+// schedule reads the scheduling columns of headword's entries row.
+func schedule(t *testing.T, db dbtx, headword string) []any {
+	t.Helper()
+	var (
+		stability, difficulty        float64
+		state, lapses, reps, version int
+		lastReview, due              time.Time
+	)
+	err := db.QueryRow(context.Background(), `
+select stability, difficulty, state, lapses, reps_ct, last_review, due_at, version
+from entries where headword = $1`, headword).
+		Scan(&stability, &difficulty, &state, &lapses, &reps, &lastReview, &due, &version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []any{stability, difficulty, state, lapses, reps, lastReview, due, version}
+}
+
+// An edit rewrites the definitions and leaves every scheduling column,
+// version included, as it was.
+func TestEditCardKeepsSchedule(t *testing.T) {
+	app, _, pool := pgTestApp(t)
+	ctx := context.Background()
+	if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, freq, stability, difficulty, state, lapses, reps_ct, last_review, due_at)
+values ('学习', 'xuexi', 'to stdy', 5, 21.5, 6.25, 2, 1, 7, '2026-03-01 09:30', '2026-03-22 09:30')`); err != nil {
+		t.Fatal(err)
+	}
+	before := schedule(t, pool, "学习")
+
+	w := postForm(app.handleEditCard, "/cards/edit", url.Values{
+		"headword":           {"学习"},
+		"pinyin":             {"xuéxí"},
+		"english_definition": {"to study"},
+		"chinese_definition": {"学而时习之"},
+		"freq":               {"120"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var pinyin, en, zh string
+	var freq int
+	if err := pool.QueryRow(ctx, `select pinyin, english_definition, chinese_definition, freq from entries where headword = '学习'`).
+		Scan(&pinyin, &en, &zh, &freq); err != nil {
+		t.Fatal(err)
+	}
+	if pinyin != "xuéxí" || en != "to study" || zh != "学而时习之" || freq != 120 {
+		t.Errorf("content = %q, %q, %q, %d; want the edit", pinyin, en, zh, freq)
+	}
+	if after := schedule(t, pool, "学习"); !reflect.DeepEqual(after, before) {
+		t.Errorf("schedule changed from %v to %v", before, after)
+	}
+
+	if w := postForm(app.handleEditCard, "/cards/edit", url.Values{"headword": {"无"}, "pinyin": {"wú"}}); w.Code != http.StatusNotFound {
+		t.Errorf("edit of an unknown card: status = %d, want 404", w.Code)
+	}
+}
+
+// A suspended card drops out of the queue in every order, keeps its
+// schedule, and comes back when unsuspended.
+func TestSuspendedCardSkipped(t *testing.T) {
+	app, clk, pool := pgTestApp(t)
+	ctx := context.Background()
+	now := clk.Now()
+	if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, freq, stability, state, reps_ct, last_review, due_at)
+values ('旧', 'jiù', 'old', 100, 5, 2, 3, $1::timestamptz - interval '7 days', $1::timestamptz - interval '2 days'),
+       ('近', 'jìn', 'near', 1, 5, 2, 3, $1::timestamptz - interval '6 days', $1::timestamptz - interval '1 day')`, now); err != nil {
+		t.Fatal(err)
+	}
+	next := func(order reviewOrder) string {
+		t.Helper()
+		c, err := getNextDueCard(ctx, pool, order, now, queueFilter{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == nil {
+			return ""
+		}
+		return c.Headword
+	}
+	if got := next(orderDue); got != "旧" {
+		t.Fatalf("next due = %q before suspending, want 旧", got)
+	}
+	before := schedule(t, pool, "旧")
+
+	suspend := func(want bool) {
+		t.Helper()
+		w := postForm(app.handleSuspendCard, "/cards/suspend", url.Values{"headword": {"旧"}})
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), fmt.Sprintf(`"suspended":%t`, want)) {
+			t.Fatalf("suspend = %d %s, want suspended %t", w.Code, w.Body, want)
+		}
+	}
+	suspend(true)
+	for _, order := range []reviewOrder{orderDue, orderFreq, orderRandom} {
+		if got := next(order); got != "近" {
+			t.Errorf("next %s = %q with 旧 suspended, want 近", order, got)
+		}
+	}
+	if after := schedule(t, pool, "旧"); !reflect.DeepEqual(after, before) {
+		t.Errorf("suspending changed the schedule from %v to %v", before, after)
+	}
+
+	suspend(false)
+	if got := next(orderDue); got != "旧" {
+		t.Errorf("next due = %q after unsuspending, want 旧", got)
+	}
+}
+
+// A soft-deleted card leaves the queue and shows in /trash; restoring it
+// brings it back with its schedule and review log intact.
+func TestSoftDeleteAndRestore(t *testing.T) {
+	app, clk, pool := pgTestApp(t)
+	ctx := context.Background()
+	now := clk.Now()
+	if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, stability, difficulty, state, lapses, reps_ct, last_review, due_at)
+values ('删', 'shān', 'delete', 8.5, 5.5, 2, 1, 4, $1::timestamptz - interval '9 days', $1::timestamptz - interval '1 day')`, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.gradeCard(ctx, "删", "", fsrs.Good, now, nil); err != nil {
+		t.Fatal(err)
+	}
+	clk.Add(60 * 24 * time.Hour)
+	now = clk.Now()
+	before := schedule(t, pool, "删")
+	next := func() *Card {
+		t.Helper()
+		c, err := getNextDueCard(ctx, pool, orderDue, now, queueFilter{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if c := next(); c == nil || c.Headword != "删" {
+		t.Fatalf("next due = %v before deleting, want 删", c)
+	}
+
+	if w := postForm(app.handleDeleteCard, "/cards/delete", url.Values{"headword": {"删"}}); w.Code != http.StatusOK {
+		t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+	}
+	if c := next(); c != nil {
+		t.Errorf("next due = %s after deleting, want nothing", c.Headword)
+	}
+	w := get(app.handleTrash, "/trash")
+	var trash struct{ Cards []trashedCard }
+	if err := json.Unmarshal(w.Body.Bytes(), &trash); err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Cards) != 1 || trash.Cards[0].Headword != "删" || trash.Cards[0].Reps != 5 {
+		t.Errorf("trash = %+v, want 删 with 5 reps", trash.Cards)
+	}
+
+	if w := postForm(app.handleRestoreCard, "/cards/restore", url.Values{"headword": {"删"}}); w.Code != http.StatusOK {
+		t.Fatalf("restore status = %d: %s", w.Code, w.Body)
+	}
+	if after := schedule(t, pool, "删"); !reflect.DeepEqual(after, before) {
+		t.Errorf("schedule changed from %v to %v", before, after)
+	}
+	if c := next(); c == nil || c.Headword != "删" {
+		t.Errorf("next due = %v after restoring, want 删", c)
+	}
+	var logged int
+	if err := pool.QueryRow(ctx, `select count(*) from review_log where headword = '删'`).Scan(&logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged != 1 {
+		t.Errorf("%d reviews logged after delete and restore, want 1", logged)
+	}
+	if w := postForm(app.handleRestoreCard, "/cards/restore", url.Values{"headword": {"删"}}); w.Code != http.StatusNotFound {
+		t.Errorf("restoring a card not in the trash: status = %d, want 404", w.Code)
+	}
+}
+
+// searchJSON runs /search?format=json for q and returns the headwords.
+func searchJSON(t *testing.T, app *application, q string) []string {
+	t.Helper()
+	w := get(app.handleSearch, "/search?format=json&q="+url.QueryEscape(q))
+	if w.Code != http.StatusOK {
+		t.Fatalf("search %q: status = %d: %s", q, w.Code, w.Body)
+	}
+	var cards []Card
+	if err := json.Unmarshal(w.Body.Bytes(), &cards); err != nil {
+		t.Fatal(err)
+	}
+	headwords := []string{}
+	for _, c := range cards {
+		headwords = append(headwords, c.Headword)
+	}
+	return headwords
+}
+
+// seedSearch adds a few cards to search among.
+func seedSearch(t *testing.T, pool *pgxpool.Pool) {
+	t.Helper()
+	if _, err := pool.Exec(context.Background(), `
+insert into entries (headword, pinyin, english_definition, freq) values
+('中国', 'Zhōng guó', 'China', 900),
+('中文', 'Zhōng wén', 'Chinese language', 500),
+('中', 'zhōng', 'middle', 1000),
+('绿', 'lǜ', 'green', 300),
+('西安', 'Xī''ān', 'Xi''an', 100)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchHeadwordAndPinyin(t *testing.T) {
+	app, _, pool := pgTestApp(t)
+	seedSearch(t, pool)
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		// An exact headword first, then by frequency.
+		{"中", []string{"中", "中国", "中文"}},
+		{"ZHONG", []string{"中", "中国", "中文"}},
+		{"guo", []string{"中国"}},
+		{"日本", []string{}},
+		{"qwerty", []string{}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		if got := searchJSON(t, app, tt.q); !slices.Equal(got, tt.want) {
+			t.Errorf("search %q = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+// Numbered, marked and toneless pinyin queries find the same cards, so
+// pinyinKeySQL folds stored pinyin as pinyinKey folds the query.
+func TestSearchToneInsensitivePinyin(t *testing.T) {
+	app, _, pool := pgTestApp(t)
+	seedSearch(t, pool)
+	for _, tt := range []struct {
+		queries []string
+		want    []string
+	}{
+		{[]string{"zhong1guo2", "zhōngguó", "zhongguo", "Zhong1 guo2"}, []string{"中国"}},
+		{[]string{"lu:4", "lǜ", "lv4", "lv"}, []string{"绿"}},
+		{[]string{"xi1'an1", "xī'ān", "xian"}, []string{"西安"}},
+	} {
+		for _, q := range tt.queries {
+			if got := searchJSON(t, app, q); !slices.Equal(got, tt.want) {
+				t.Errorf("search %q = %v, want %v", q, got, tt.want)
+			}
+		}
+	}
+}
+
+// logReviewsAt adds a Good review of 好 to review_log at each time.
+func logReviewsAt(t *testing.T, pool *pgxpool.Pool, at ...time.Time) {
+	t.Helper()
+	for _, ts := range at {
+		if _, err := pool.Exec(context.Background(), `
+insert into review_log (headword, rating, old_stability, new_stability, old_difficulty, new_difficulty,
+    old_state, new_state, old_lapses, old_reps, old_due, new_due, reviewed_at)
+values ('好', 3, 1, 2, 5, 5, 2, 2, 0, 1, $1, $1, $1)`, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Streak days are local days: reviews either side of local midnight are
+// two days in the user's zone, even when they share a UTC date.
+func TestStreakLocalMidnight(t *testing.T) {
+	app, clk, pool := pgTestApp(t)
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 23:30 and 00:30 New York time (EDT) are 03:30 and 04:30 UTC on 11
+	// March.
+	logReviewsAt(t, pool,
+		time.Date(2025, 3, 10, 23, 30, 0, 0, ny),
+		time.Date(2025, 3, 11, 0, 30, 0, 0, ny),
+	)
+	clk.Add(time.Date(2025, 3, 11, 20, 0, 0, 0, ny).Sub(clk.Now()))
+
+	for _, tt := range []struct {
+		tz               string
+		current, longest int
+		last             string
+	}{
+		{"America/New_York", 2, 2, "2025-03-11"},
+		{"UTC", 1, 1, "2025-03-11"},
+	} {
+		w := get(app.handleStreak, "/streak?tz="+tt.tz)
+		var got struct {
+			Current, Longest int
+			Last             string `json:"last_review_date"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v: %s", tt.tz, err, w.Body)
+		}
+		if got.Current != tt.current || got.Longest != tt.longest || got.Last != tt.last {
+			t.Errorf("streak in %s = %+v, want current %d, longest %d, last %s", tt.tz, got, tt.current, tt.longest, tt.last)
+		}
+	}
+}
+
+// A card due at 23:00 local time is due from that instant, not at a
+// UTC day boundary, and the heatmap buckets reviews by local day.
+func TestLocalTimeBoundaries(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	sh, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	due := time.Date(2025, 3, 10, 23, 0, 0, 0, sh)
+	if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, stability, state, reps_ct, last_review, due_at)
+values ('晚', 'wǎn', 'late', 5, 2, 3, $1::timestamptz - interval '5 days', $1)`, due); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{due.Add(-time.Second), false},
+		{due, true},
+		{due.Add(30 * time.Minute), true},
+	} {
+		c, err := getNextDueCard(ctx, pool, orderDue, tt.at, queueFilter{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (c != nil) != tt.want {
+			t.Errorf("at %v: due card = %v, want due %t", tt.at, c, tt.want)
+		}
+	}
+
+	// 23:30 and 00:30 Shanghai time are 15:30 and 16:30 UTC on 10 March.
+	logReviewsAt(t, pool, due.Add(30*time.Minute), due.Add(90*time.Minute))
+	now := time.Date(2025, 3, 11, 12, 0, 0, 0, sh)
+	for _, tt := range []struct {
+		loc  *time.Location
+		want []heatmapDay
+	}{
+		{sh, []heatmapDay{{"2025-03-10", 1}, {"2025-03-11", 1}}},
+		{time.UTC, []heatmapDay{{"2025-03-10", 2}, {"2025-03-11", 0}}},
+	} {
+		got, err := getHeatmap(ctx, pool, 2, tt.loc, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("heatmap in %s = %v, want %v", tt.loc, got, tt.want)
+		}
+	}
+}
+
+// Cards due at the same instant come out in one fixed order, most
+// frequent first and then by headword, in the entries queue and the
+// aspect queue alike, however often the queue is asked.
+func TestDueTiesOrderedStably(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	now := testEpoch
+	due := now.Add(-time.Hour)
+	if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, freq, stability, state, reps_ct, last_review, due_at)
+select hw, 'x', 'x', f, 5, 2, 3, $1::timestamptz - interval '5 days', $1::timestamptz
+from (values ('甲', null), ('乙', 50), ('丙', 50), ('丁', 900), ('戊', 50)) as v(hw, f)`, due); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, `
+insert into card_aspects (headword, aspect, stability, state, reps_ct, last_review, due_at)
+select headword, 'production', 5, 2, 3, last_review, due_at from entries`); err != nil {
+		t.Fatal(err)
+	}
+	// Ties on freq go by headword in the database's collation.
+	rows, err := pool.Query(ctx, `select headword from entries where freq = 50 order by headword`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fifties, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]string{"丁"}, fifties...), "甲")
+
+	for _, q := range []struct {
+		name  string
+		table string
+		next  func() (*Card, error)
+	}{
+		{"entries", "entries", func() (*Card, error) {
+			return getNextDueCard(ctx, pool, orderDue, now, queueFilter{}, false)
+		}},
+		{"aspects", "card_aspects", func() (*Card, error) {
+			return getNextDueAspectCard(ctx, pool, []string{"production"}, orderDue, now, queueFilter{}, false)
+		}},
+	} {
+		t.Run(q.name, func(t *testing.T) {
+			for pass := range 2 {
+				if _, err := pool.Exec(ctx, `update `+q.table+` set due_at = $1`, due); err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for {
+					c, err := q.next()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if c == nil {
+						break
+					}
+					for range 3 {
+						if again, err := q.next(); err != nil || again == nil || again.Headword != c.Headword {
+							t.Fatalf("pass %d: next due flipped from %s to %v (%v)", pass, c.Headword, again, err)
+						}
+					}
+					got = append(got, c.Headword)
+					if _, err := pool.Exec(ctx, `update `+q.table+` set due_at = due_at + interval '1 year' where headword = $1`, c.Headword); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("pass %d: queue order %v, want %v", pass, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Two grades of one card at once both land through the real repository:
+// Lock's select ... for update makes the second wait for the first to
+// commit and then build on it, where without the row lock it would read
+// the same version and fail as stale. A third transaction holds the row
+// until both grades are waiting on it, so they really do overlap.
+func TestConcurrentGradesLockTheRow(t *testing.T) {
+	app, clk, pool := pgTestApp(t)
+	ctx := context.Background()
+	if _, err := pool.Exec(ctx, `insert into entries (headword, pinyin, english_definition, last_review, due_at) values ('好', 'hǎo', 'good', $1, $1)`, clk.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	hold, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hold.Rollback(ctx)
+	if _, err := hold.Exec(ctx, `select 1 from entries where headword = '好' for update`); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := app.gradeCard(ctx, "好", "", fsrs.Good, clk.Now(), nil)
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var waiting int
+		// The second grade may queue behind the first rather than behind
+		// hold directly, so count every backend blocked on a lock.
+		if err := pool.QueryRow(ctx, `select count(*) from pg_stat_activity where datname = current_database() and cardinality(pg_blocking_pids(pid)) > 0`).Scan(&waiting); err != nil {
+			t.Fatal(err)
+		}
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d grades waiting on the held row, want 2", waiting)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := hold.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reps, version, logged int
+	if err := pool.QueryRow(ctx, `select reps_ct, version, (select count(*) from review_log where headword = '好') from entries where headword = '好'`).
+		Scan(&reps, &version, &logged); err != nil {
+		t.Fatal(err)
+	}
+	if reps != 2 || version != 2 || logged != 2 {
+		t.Errorf("reps_ct = %d, version = %d, review_log rows = %d; want 2, 2, 2", reps, version, logged)
+	}
+}
+
+// A reschedule leaves trashed cards alone and keeps immature ones within
+// the immature cap, and /api/params/impact previews exactly what it
+// writes.
+func TestRescheduleSkipsTrashAndClampsImmature(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	s := newScheduling(dbConfig{FSRS: fsrs.DefaultParam(), MinRepsBeforeMature: 3, ImmatureMaxIntervalDays: 7})
+	reviewed := testEpoch.AddDate(0, 0, -1)
+	stale := testEpoch.AddDate(1, 0, 0)
+	if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, stability, difficulty, state, reps_ct, last_review, due_at, deleted_at)
+values ('熟', 'shú', 'mature', 100, 5, 2, 5, $1::timestamptz, $2::timestamptz, null),
+       ('生', 'shēng', 'immature', 100, 5, 2, 1, $1::timestamptz, $2::timestamptz, null),
+       ('删', 'shān', 'trashed', 100, 5, 2, 5, $1::timestamptz, $2::timestamptz, now())`, reviewed, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, `
+insert into card_aspects (headword, aspect, stability, difficulty, state, reps_ct, last_review, due_at)
+select headword, 'production', stability, difficulty, state, reps_ct, last_review, due_at from entries`); err != nil {
+		t.Fatal(err)
+	}
+
+	impacts, examined, err := getParamImpact(ctx, pool, s, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if examined != 4 {
+		t.Errorf("impact examined %d cards, want the 4 untrashed", examined)
+	}
+	preview := map[[2]string]time.Time{}
+	for _, im := range impacts {
+		preview[[2]string{im.Headword, im.Aspect}] = im.WouldBeDue
+	}
+
+	examined, moved, err := rescheduleCards(ctx, pool, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if examined != 4 || moved != 4 {
+		t.Errorf("rescheduled %d of %d examined, want 4 of 4", moved, examined)
+	}
+	full := reviewed.Add(time.Duration(intervalDays(s.fsrs.Parameters, 100)) * 24 * time.Hour)
+	for _, tt := range []struct {
+		headword string
+		want     time.Time
+	}{
+		{"熟", full},
+		{"生", reviewed.AddDate(0, 0, 7)},
+		{"删", stale},
+	} {
+		for _, q := range []struct{ aspect, sql string }{
+			{"recognition", `select due_at, version from entries where headword = $1`},
+			{"production", `select due_at, version from card_aspects where headword = $1`},
+		} {
+			var (
+				due     time.Time
+				version int
+			)
+			if err := pool.QueryRow(ctx, q.sql, tt.headword).Scan(&due, &version); err != nil {
+				t.Fatal(err)
+			}
+			if !due.Equal(tt.want) {
+				t.Errorf("%s %s due %v, want %v", tt.headword, q.aspect, due, tt.want)
+			}
+			if tt.headword == "删" {
+				if version != 0 {
+					t.Errorf("trashed %s version = %d, want 0", q.aspect, version)
+				}
+				continue
+			}
+			if p := preview[[2]string{tt.headword, q.aspect}]; !p.Equal(due) {
+				t.Errorf("%s %s previewed at %v, rescheduled to %v", tt.headword, q.aspect, p, due)
+			}
+		}
+	}
+}
+
+// Ending a vacation reports as away exactly the time the schedule was
+// shifted by, both measured on the app's clock.
+func TestVacationEndReportsTheShift(t *testing.T) {
+	app, clk, pool := pgTestApp(t)
+	ctx := context.Background()
+	due := clk.Now().AddDate(0, 0, 2)
+	if _, err := pool.Exec(ctx, `
+insert into entries (headword, pinyin, english_definition, stability, state, reps_ct, last_review, due_at)
+values ('假', 'jià', 'holiday', 5, 2, 3, $1::timestamptz - interval '3 days', $2::timestamptz)`, clk.Now(), due); err != nil {
+		t.Fatal(err)
+	}
+	if w := postJSON(app.handleVacationStart, "/api/vacation/start", ""); w.Code != http.StatusOK {
+		t.Fatalf("start status = %d: %s", w.Code, w.Body)
+	}
+	clk.Add(72 * time.Hour)
+	w := postJSON(app.handleVacationEnd, "/api/vacation/end", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("end status = %d: %s", w.Code, w.Body)
+	}
+	var got struct {
+		AwayHours float64 `json:"away_hours"`
+		Shifted   int     `json:"shifted"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.AwayHours != 72 || got.Shifted != 1 {
+		t.Errorf("away %v hours, %d shifted; want 72 and 1", got.AwayHours, got.Shifted)
+	}
+	var after time.Time
+	if err := pool.QueryRow(ctx, `select due_at from entries where headword = '假'`).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if want := due.Add(72 * time.Hour); !after.Equal(want) {
+		t.Errorf("due %v after the vacation, want %v", after, want)
+	}
+}
@@ -0,0 +1,17 @@
+-- The entries table as it stood before migrations/0001, when the
+-- dictionary loader created it. Tests that need Postgres build their
+-- schema from this plus every migration, as a deployed database has it.
+create table entries (
+    headword           text      primary key,
+    pinyin             text      not null,
+    english_definition text      not null,
+    chinese_definition text      not null default '',
+    freq               integer,
+    stability          float8    not null default 0,
+    difficulty         float8    not null default 0,
+    lapses             integer   not null default 0,
+    state              integer   not null default 0,
+    last_review        timestamp not null default now(),
+    due_at             timestamp not null default now(),
+    reps_ct            integer   not null default 0
+);
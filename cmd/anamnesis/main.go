@@ -0,0 +1,8 @@
+// Command anamnesis serves the review app as a standalone HTTP server.
+package main
+
+import handler "anamnesis/api"
+
+func main() {
+	handler.Main()
+}